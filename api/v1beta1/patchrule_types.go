@@ -17,30 +17,93 @@ limitations under the License.
 package v1beta1
 
 import (
+	"github.com/fluxcd/pkg/apis/meta"
+	corev1 "k8s.io/api/core/v1"
 	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
-	ActiveCondition             = "Active"
-	FailedReason                = "Failed"
-	InactiveReason              = "Inactive"
-	PendingReason               = "Pending"
-	ActiveReason                = "Active"
-	InvalidPrometheusURLReason  = "InvalidPrometheusURL"
-	PrometheusQueryFailedReason = "PrometheusQueryFailed"
-	PatchAppliedCondition       = "PatchApplied"
-	PatchApplyFailedReason      = "Failed"
-	PatchAppliedReason          = "Applied"
-	NoPatchFoundReason          = "NoPatchFound"
+	PrometheusPatchRuleKind = "PrometheusPatchRule"
+)
+
+const (
+	TargetModeStatic    = "Static"
+	TargetModePerSample = "PerSample"
+)
+
+const (
+	PatchTypeJSON6902       = "JSON6902"
+	PatchTypeStrategicMerge = "StrategicMerge"
+	PatchTypeMerge          = "Merge"
+	PatchTypeApply          = "Apply"
+)
+
+const (
+	StateInactive = "Inactive"
+	StatePending  = "Pending"
+	StateFiring   = "Firing"
+)
+
+const (
+	NonFinitePolicyIgnore   = "Ignore"
+	NonFinitePolicyMatch    = "Match"
+	NonFinitePolicyInactive = "Inactive"
+)
+
+const (
+	FailurePolicyFailFast = "FailFast"
+	FailurePolicyContinue = "Continue"
+)
+
+const (
+	TargetResultApplied    = "Applied"
+	TargetResultFailed     = "Failed"
+	TargetResultDryRun     = "DryRun"
+	TargetResultRolledBack = "RolledBack"
+	TargetResultUnchanged  = "Unchanged"
+)
+
+const (
+	ActiveCondition               = "Active"
+	FailedReason                  = "Failed"
+	InactiveReason                = "Inactive"
+	PendingReason                 = "Pending"
+	ActiveReason                  = "Active"
+	InvalidPrometheusURLReason    = "InvalidPrometheusURL"
+	InvalidPrometheusConfigReason = "InvalidPrometheusConfig"
+	PrometheusQueryFailedReason   = "PrometheusQueryFailed"
+	PatchAppliedCondition         = "PatchApplied"
+	PatchApplyFailedReason        = "Failed"
+	PatchAppliedReason            = "Applied"
+	NoPatchFoundReason            = "NoPatchFound"
+	PatchRevertedReason           = "Reverted"
+	PatchRevertFailedReason       = "RevertFailed"
+	DryRunReason                  = "DryRun"
+	UnknownTargetReason           = "UnknownTarget"
+	PartiallyAppliedReason        = "PartiallyApplied"
+	RolledBackReason              = "RolledBack"
+	RollbackFailedReason          = "RollbackFailed"
+	InvalidKubeConfigReason       = "InvalidKubeConfig"
+	ServiceAccountNotFoundReason  = "ServiceAccountNotFound"
+	CooldownReason                = "Cooldown"
+	OutsideScheduleReason         = "OutsideSchedule"
+	InvalidScheduleReason         = "InvalidSchedule"
 )
 
 // PrometheusPatchRuleSpec defines the desired state of PrometheusPatchRule
 type PrometheusPatchRuleSpec struct {
-	// Prometheus holds information about where to find prometheus
-	// +required
-	Prometheus PrometheusSpec `json:"prometheus"`
+	// Prometheus holds information about where to find prometheus.
+	// Either prometheus or prometheusRef is required.
+	// +optional
+	Prometheus PrometheusSpec `json:"prometheus,omitempty"`
+
+	// PrometheusRef references a PrometheusSource or ClusterPrometheusSource
+	// which is used instead of an inline prometheus spec.
+	// +optional
+	PrometheusRef *PrometheusReference `json:"prometheusRef,omitempty"`
 
 	// Interval is the duration in which the expression gets evaluated
 	// +required
@@ -54,18 +117,328 @@ type PrometheusPatchRuleSpec struct {
 	// +required
 	For metav1.Duration `json:"for,omitempty"`
 
+	// Condition compares the values of the query samples against thresholds.
+	// By default any sample returned by the expression activates the rule.
+	// +optional
+	Condition *Condition `json:"condition,omitempty"`
+
+	// KeepFiringFor is the duration a firing rule keeps firing after the expression stopped returning samples.
+	// Patches are neither reverted nor re-applied while the rule keeps firing.
+	// +optional
+	KeepFiringFor *metav1.Duration `json:"keepFiringFor,omitempty"`
+
+	// ResolveAfter is the duration a pending rule stays pending after the expression stopped returning samples.
+	// This prevents a single empty evaluation (for example caused by a scrape gap) from restarting the pending window.
+	// +optional
+	ResolveAfter *metav1.Duration `json:"resolveAfter,omitempty"`
+
+	// Cooldown is the minimum duration between two changes of the targets.
+	// After the patches have been applied, a different tier became active or the patches have been reverted
+	// neither a different patch set is applied nor are the patches reverted until the cooldown elapsed.
+	// +optional
+	Cooldown *metav1.Duration `json:"cooldown,omitempty"`
+
+	// Schedule defines the time windows during which the rule is evaluated and may fire.
+	// Outside of the schedule the rule is inactive. By default the rule is always evaluated.
+	// +optional
+	Schedule *Schedule `json:"schedule,omitempty"`
+
+	// Blackouts define time windows during which the rule is neither evaluated nor are patches applied or reverted.
+	// +optional
+	Blackouts []Blackout `json:"blackouts,omitempty"`
+
 	// .JSON6902Patches define to what target are applied what patches
-	// +required
+	// +optional
 	JSON6902Patches []JSON6902Patch `json:"json6902Patches,omitempty"`
 
+	// ApplyPatches define partial manifests which are applied to the targets using server side apply.
+	// +optional
+	ApplyPatches []ApplyPatch `json:"applyPatches,omitempty"`
+
+	// StrategicMergePatches define strategic merge patches which are applied to the targets.
+	// +optional
+	StrategicMergePatches []MergePatch `json:"strategicMergePatches,omitempty"`
+
+	// MergePatches define JSON merge patches (RFC 7386) which are applied to the targets.
+	// +optional
+	MergePatches []MergePatch `json:"mergePatches,omitempty"`
+
+	// Tiers define additional patches for value ranges of the query result.
+	// The first tier whose range contains the sample value is active and its patches are applied
+	// after the patches of the rule.
+	// +optional
+	Tiers []Tier `json:"tiers,omitempty"`
+
+	// TargetMode defines how the query samples are mapped to patch targets.
+	// Static renders targets and patches once using the first sample while PerSample renders and applies
+	// all patches once for each sample. This allows to fill the target namespace, name or labelSelector from sample labels.
+	// +kubebuilder:validation:Enum=Static;PerSample
+	// +kubebuilder:default=Static
+	// +optional
+	TargetMode string `json:"targetMode,omitempty"`
+
+	// FailurePolicy defines how failing patches are handled.
+	// FailFast stops at the first failing patch while Continue applies all remaining patches
+	// and reports the aggregated errors.
+	// +kubebuilder:validation:Enum=FailFast;Continue
+	// +kubebuilder:default=FailFast
+	// +optional
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+
+	// KubeConfig references a secret holding a kubeconfig of a remote cluster.
+	// If set the targets are looked up and patched in the remote cluster instead of the cluster
+	// the controller is running in. The secret must exist in the same namespace as the PrometheusPatchRule.
+	// +optional
+	KubeConfig *meta.KubeConfigReference `json:"kubeConfig,omitempty"`
+
+	// ServiceAccountName is the name of a ServiceAccount in the namespace of the PrometheusPatchRule
+	// which is impersonated to find and patch the targets.
+	// If not set the default service account configured on the controller is used (if any).
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Enforce watches the patched targets while the rule is active and re-applies the patches
+	// as soon as a target changes instead of waiting for the next interval.
+	// +optional
+	Enforce bool `json:"enforce,omitempty"`
+
+	// Atomic applies all patches as a whole. The original state of each target is captured before it gets patched.
+	// If a patch fails all targets which have already been patched are rolled back in reverse order.
+	// Atomic implies the FailFast failure policy.
+	// +optional
+	Atomic bool `json:"atomic,omitempty"`
+
+	// DryRun sends all patches as dry run requests. Nothing gets persisted, instead the
+	// resulting diff of each target is recorded in the status.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
 	// Suspend may suspend reconciliation of the resource.
 	// +optional
 	Suspend bool `json:"suspend,omitempty"`
+
+	// Revert restores the original values of all patched paths as soon as the expression
+	// does not return samples anymore. Array elements can not be reverted, use applyPatches instead.
+	// +optional
+	Revert bool `json:"revert,omitempty"`
+}
+
+// Condition defines when the query samples activate a rule.
+// Separate thresholds for activation and deactivation allow hysteresis, for example activate above 80 and deactivate below 60.
+type Condition struct {
+	// Operator compares the sample value (left side) against the threshold (right side).
+	// +kubebuilder:validation:Enum=">";">=";"<";"<=";"==";"!="
+	// +required
+	Operator string `json:"operator"`
+
+	// ActivateThreshold is the threshold a sample must match to activate an inactive rule.
+	// +required
+	ActivateThreshold resource.Quantity `json:"activateThreshold"`
+
+	// DeactivateThreshold is the threshold a sample must match to keep a pending or firing rule active.
+	// If not set the activate threshold is used.
+	// +optional
+	DeactivateThreshold *resource.Quantity `json:"deactivateThreshold,omitempty"`
+
+	// NonFinitePolicy defines how NaN and infinite sample values are handled.
+	// Ignore drops such samples, Match treats them as matching the threshold while Inactive
+	// treats the whole evaluation as not matching.
+	// +kubebuilder:validation:Enum=Ignore;Match;Inactive
+	// +kubebuilder:default=Ignore
+	// +optional
+	NonFinitePolicy string `json:"nonFinitePolicy,omitempty"`
+
+	// MinSamples is the minimum number of matching samples required to activate the rule.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=1
+	// +optional
+	MinSamples int `json:"minSamples,omitempty"`
 }
 
-// PrometheusSpec contains specs for accessing prometheus
+// Schedule is a set of recurring time windows
+type Schedule struct {
+	// TimeZone is the IANA time zone name (for example Europe/Zurich) the cron expressions are evaluated in.
+	// Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Windows during which the rule is evaluated.
+	// +kubebuilder:validation:MinItems=1
+	// +required
+	Windows []Window `json:"windows"`
+}
+
+// Window is a recurring time window
+type Window struct {
+	// Cron is a standard cron expression with five fields which defines when the window starts.
+	// +required
+	Cron string `json:"cron"`
+
+	// Duration of the window.
+	// +required
+	Duration metav1.Duration `json:"duration"`
+}
+
+// Blackout is either a recurring time window or a fixed time range
+type Blackout struct {
+	// Name of the blackout, it is reported in the status conditions.
+	// +required
+	Name string `json:"name"`
+
+	// TimeZone is the IANA time zone name the cron expression is evaluated in.
+	// Defaults to UTC.
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Cron is a standard cron expression with five fields which defines when a recurring blackout starts.
+	// +optional
+	Cron string `json:"cron,omitempty"`
+
+	// Duration of a recurring blackout.
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+
+	// Start of a fixed blackout.
+	// +optional
+	Start *metav1.Time `json:"start,omitempty"`
+
+	// End of a fixed blackout.
+	// +optional
+	End *metav1.Time `json:"end,omitempty"`
+}
+
+// Tier is a set of patches which is applied if the sample value is within the range of the tier
+type Tier struct {
+	// Name of the tier, it is reported in status.activeTier.
+	// +required
+	Name string `json:"name"`
+
+	// Min is the inclusive lower bound of the value range. If not set the range is unbounded.
+	// +optional
+	Min *resource.Quantity `json:"min,omitempty"`
+
+	// Max is the exclusive upper bound of the value range. If not set the range is unbounded.
+	// +optional
+	Max *resource.Quantity `json:"max,omitempty"`
+
+	// .JSON6902Patches define to what target are applied what patches
+	// +optional
+	JSON6902Patches []JSON6902Patch `json:"json6902Patches,omitempty"`
+
+	// ApplyPatches define partial manifests which are applied to the targets using server side apply.
+	// +optional
+	ApplyPatches []ApplyPatch `json:"applyPatches,omitempty"`
+
+	// StrategicMergePatches define strategic merge patches which are applied to the targets.
+	// +optional
+	StrategicMergePatches []MergePatch `json:"strategicMergePatches,omitempty"`
+
+	// MergePatches define JSON merge patches (RFC 7386) which are applied to the targets.
+	// +optional
+	MergePatches []MergePatch `json:"mergePatches,omitempty"`
+}
+
+// PrometheusReference points to a PrometheusSource or ClusterPrometheusSource
+type PrometheusReference struct {
+	// Kind of the referenced source.
+	// +kubebuilder:validation:Enum=PrometheusSource;ClusterPrometheusSource
+	// +kubebuilder:default=PrometheusSource
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// Name of the referenced source.
+	// A PrometheusSource must exist in the same namespace as the PrometheusPatchRule.
+	// +required
+	Name string `json:"name"`
+}
+
+// PrometheusSpec contains specs for accessing prometheus.
+// Referenced secrets and configmaps are looked up in the namespace of the PrometheusPatchRule or PrometheusSource
+// holding the spec. For a ClusterPrometheusSource they are looked up in the namespace the controller runs in.
 type PrometheusSpec struct {
-	Address string `json:"address"`
+	// Address of the prometheus http api.
+	// +optional
+	Address string `json:"address,omitempty"`
+
+	// Timeout is the maximum duration a query may take.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// BearerTokenSecret references a secret key holding a bearer token which is sent
+	// as Authorization header with each query.
+	// The secret must exist in the namespace of the resource holding this spec, for a ClusterPrometheusSource
+	// in the namespace the controller runs in.
+	// +optional
+	BearerTokenSecret *corev1.SecretKeySelector `json:"bearerTokenSecret,omitempty"`
+
+	// BasicAuth holds the credentials for basic authentication.
+	// +optional
+	BasicAuth *BasicAuth `json:"basicAuth,omitempty"`
+
+	// TLSConfig holds the TLS configuration used to connect to prometheus.
+	// +optional
+	TLSConfig *TLSConfig `json:"tlsConfig,omitempty"`
+
+	// Headers are additional http headers sent with each query, for example
+	// X-Scope-OrgID for multi tenant backends.
+	// +optional
+	Headers map[string]HeaderValue `json:"headers,omitempty"`
+}
+
+// HeaderValue is the value of a http header, either set directly or sourced from a secret
+type HeaderValue struct {
+	// Value is the plain header value.
+	// +optional
+	Value string `json:"value,omitempty"`
+
+	// SecretKeyRef references a secret key holding the header value.
+	// +optional
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+// BasicAuth holds references to the basic authentication credentials
+type BasicAuth struct {
+	// Username references a secret key holding the username.
+	// +required
+	Username corev1.SecretKeySelector `json:"username"`
+
+	// Password references a secret key holding the password.
+	// +required
+	Password corev1.SecretKeySelector `json:"password"`
+}
+
+// TLSConfig holds the TLS settings for the prometheus connection
+type TLSConfig struct {
+	// CA is the certificate authority bundle used to verify the server certificate.
+	// +optional
+	CA *SecretOrConfigMap `json:"ca,omitempty"`
+
+	// Cert is the client certificate used for mTLS.
+	// +optional
+	Cert *SecretOrConfigMap `json:"cert,omitempty"`
+
+	// KeySecret references a secret key holding the private key of the client certificate.
+	// +optional
+	KeySecret *corev1.SecretKeySelector `json:"keySecret,omitempty"`
+
+	// ServerName is used to verify the hostname of the server certificate.
+	// +optional
+	ServerName string `json:"serverName,omitempty"`
+
+	// InsecureSkipVerify disables the verification of the server certificate.
+	// +optional
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+// SecretOrConfigMap references a key of either a secret or a configmap
+type SecretOrConfigMap struct {
+	// Secret references a secret key.
+	// +optional
+	Secret *corev1.SecretKeySelector `json:"secret,omitempty"`
+
+	// ConfigMap references a configmap key.
+	// +optional
+	ConfigMap *corev1.ConfigMapKeySelector `json:"configMap,omitempty"`
 }
 
 // JSON6902Patch is a target selector and a list of JSON6902 patches
@@ -80,11 +453,51 @@ type JSON6902Patch struct {
 	Target Selector `json:"target,omitempty"`
 }
 
+// ApplyPatch is a target selector and a partial manifest applied using server side apply
+type ApplyPatch struct {
+	// Patch is a partial manifest of the target resource.
+	// apiVersion, kind, metadata.name and metadata.namespace are set from the selected resource.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	// +required
+	Patch extv1.JSON `json:"patch"`
+
+	// Target points to the resources that the patch document should be applied to.
+	// +optional
+	Target Selector `json:"target,omitempty"`
+}
+
+// MergePatch is a target selector and a strategic merge or JSON merge patch document
+type MergePatch struct {
+	// Patch is the patch document.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	// +required
+	Patch extv1.JSON `json:"patch"`
+
+	// Target points to the resources that the patch document should be applied to.
+	// +optional
+	Target Selector `json:"target,omitempty"`
+}
+
 // JSONPatch is a JSON 6902 conform patch
 type JSONPatch struct {
-	OP    string     `json:"op"`
-	Path  string     `json:"path"`
-	Value extv1.JSON `json:"value"`
+	OP string `json:"op"`
+
+	// Path is a JSON pointer. It may contain a go template which gets rendered
+	// with the query sample, see ValueTemplate.
+	Path string `json:"path"`
+
+	// Value is a static value.
+	// +optional
+	Value extv1.JSON `json:"value,omitempty"`
+
+	// ValueTemplate is a go template which gets rendered and decoded as YAML (or JSON) to build the value.
+	// The template has access to .Value and .Labels of the query sample as well as to .Rule which holds
+	// the metadata of the PrometheusPatchRule. The functions int, float, quote and toJson are available.
+	// If set it takes precedence over Value.
+	// +optional
+	ValueTemplate string `json:"valueTemplate,omitempty"`
 }
 
 // Selector specifies a set of resources. Any resource that matches intersection of all conditions is included in this
@@ -98,6 +511,7 @@ type Selector struct {
 
 	// Version of the API Group to select resources from.
 	// Together with Group and Kind it is capable of unambiguously identifying and/or selecting resources.
+	// If omitted the preferred version of the api server is used.
 	// https://github.com/kubernetes/community/blob/master/contributors/design-proposals/api-machinery/api-group.md
 	// +optional
 	Version string `json:"version,omitempty"`
@@ -109,17 +523,31 @@ type Selector struct {
 	// +optional
 	Kind string `json:"kind,omitempty"`
 
+	// Resource is the plural lowercase resource name, for example deployments.
+	// It may be used instead of Kind.
+	// +optional
+	Resource string `json:"resource,omitempty"`
+
 	// Namespace to select resources from.
+	// May contain a go template which gets rendered with the query sample.
 	// +optional
 	Namespace string `json:"namespace,omitempty"`
 
+	// NamespaceSelector is a label selection expression which matches namespace labels.
+	// Resources are only selected from matching namespaces. If Namespace is set as well
+	// it must match the selector.
+	// +optional
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+
 	// Name to match resources with.
+	// May contain a go template which gets rendered with the query sample.
 	// +optional
 	Name string `json:"name,omitempty"`
 
 	// LabelSelector is a string that follows the label selection expression
 	// https://kubernetes.io/docs/concepts/overview/working-with-objects/labels/#api
 	// It matches with the resource labels.
+	// May contain a go template which gets rendered with the query sample.
 	// +optional
 	LabelSelector string `json:"labelSelector,omitempty"`
 }
@@ -129,6 +557,125 @@ type PrometheusPatchRuleStatus struct {
 	// Conditions holds the conditions for the PrometheusPatchRule.
 	// +optional
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// ObservedGeneration is the last generation of the rule which has been evaluated.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// State of the rule, one of Inactive, Pending or Firing.
+	// The rule is pending as soon as the expression returns samples and fires once it kept returning samples for spec.for.
+	// +optional
+	State string `json:"state,omitempty"`
+
+	// ActiveAt is the time the expression started returning samples.
+	// +optional
+	ActiveAt *metav1.Time `json:"activeAt,omitempty"`
+
+	// FiredAt is the time the rule started firing.
+	// +optional
+	FiredAt *metav1.Time `json:"firedAt,omitempty"`
+
+	// ResolvingSince is the time the expression stopped returning samples while the rule is kept pending or firing
+	// because of spec.resolveAfter or spec.keepFiringFor.
+	// +optional
+	ResolvingSince *metav1.Time `json:"resolvingSince,omitempty"`
+
+	// LastEvaluation is the time the expression was last evaluated.
+	// +optional
+	LastEvaluation *metav1.Time `json:"lastEvaluation,omitempty"`
+
+	// ActiveTier is the name of the tier selected by the last evaluation.
+	// +optional
+	ActiveTier string `json:"activeTier,omitempty"`
+
+	// LastChangeAt is the last time the patches have been applied, a different tier became active
+	// or the patches have been reverted. The cooldown starts at this time.
+	// +optional
+	LastChangeAt *metav1.Time `json:"lastChangeAt,omitempty"`
+
+	// Snapshots holds the original values of all paths which have been patched
+	// while the rule was active. Only recorded if spec.revert is enabled.
+	// +optional
+	Snapshots []ObjectSnapshot `json:"snapshots,omitempty"`
+
+	// Applied holds the resources server side apply patches have been applied to.
+	// Only recorded if spec.revert is enabled.
+	// +optional
+	Applied []ResourceReference `json:"applied,omitempty"`
+
+	// Targets holds the patch result of each target from the last evaluation.
+	// +optional
+	Targets []TargetStatus `json:"targets,omitempty"`
+}
+
+// TargetStatus is the patch result of a single target
+type TargetStatus struct {
+	ResourceReference `json:",inline"`
+
+	// PatchType is the type of the patch, one of JSON6902, StrategicMerge, Merge or Apply.
+	PatchType string `json:"patchType"`
+
+	// PatchIndex is the index of the patch within the patches of the same type.
+	// For patches of a tier the index refers to the patches of the tier.
+	PatchIndex int `json:"patchIndex"`
+
+	// Tier is the name of the tier the patch belongs to. It is empty for patches of the rule itself.
+	// +optional
+	Tier string `json:"tier,omitempty"`
+
+	// Result of the patch, one of Applied, Unchanged, Failed, DryRun or RolledBack.
+	Result string `json:"result"`
+
+	// Error holds the error message if the patch failed.
+	// +optional
+	Error string `json:"error,omitempty"`
+
+	// LastAppliedTime is the last time the patch was successfully applied.
+	// +optional
+	LastAppliedTime *metav1.Time `json:"lastAppliedTime,omitempty"`
+
+	// ResourceVersion of the target after the patch was applied.
+	// +optional
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+
+	// Diff is a JSON merge patch describing the changes the patch would apply in dry run mode.
+	// +optional
+	Diff string `json:"diff,omitempty"`
+}
+
+// ResourceReference points to a kubernetes object
+type ResourceReference struct {
+	// APIVersion of the referenced object.
+	APIVersion string `json:"apiVersion"`
+
+	// Kind of the referenced object.
+	Kind string `json:"kind"`
+
+	// Namespace of the referenced object.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// Name of the referenced object.
+	Name string `json:"name"`
+}
+
+// ObjectSnapshot holds the original values of the patched paths of an object
+type ObjectSnapshot struct {
+	ResourceReference `json:",inline"`
+
+	// Paths holds the original value of each patched JSON pointer in the order they have been recorded.
+	// +optional
+	Paths []PathSnapshot `json:"paths,omitempty"`
+}
+
+// PathSnapshot is the original value of a JSON pointer
+type PathSnapshot struct {
+	// Path is a JSON pointer.
+	Path string `json:"path"`
+
+	// Value is the original value of the path. It is empty if the path did not exist.
+	// +optional
+	Value *extv1.JSON `json:"value,omitempty"`
 }
 
 // ConditionalResource is a resource with conditions
@@ -177,6 +724,12 @@ func PrometheusPatchRulePatchApplied(rule PrometheusPatchRule, reason string) Pr
 	return rule
 }
 
+// PrometheusPatchRulePatchReverted
+func PrometheusPatchRulePatchReverted(rule PrometheusPatchRule, message string) PrometheusPatchRule {
+	setResourceCondition(&rule, PatchAppliedCondition, metav1.ConditionFalse, PatchRevertedReason, message)
+	return rule
+}
+
 // GetStatusConditions returns a pointer to the Status.Conditions slice
 func (in *PrometheusPatchRule) GetStatusConditions() *[]metav1.Condition {
 	return &in.Status.Conditions
@@ -184,7 +737,9 @@ func (in *PrometheusPatchRule) GetStatusConditions() *[]metav1.Condition {
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="State",type="string",JSONPath=".status.state",description=""
 // +kubebuilder:printcolumn:name="Active",type="string",JSONPath=".status.conditions[?(@.type==\"Active\")].status",description=""
+// +kubebuilder:printcolumn:name="Tier",type="string",JSONPath=".status.activeTier",description="",priority=1
 // +kubebuilder:printcolumn:name="Reason",type="string",JSONPath=".status.conditions[?(@.type==\"Active\")].reason",description=""
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description=""
 
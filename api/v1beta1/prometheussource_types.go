@@ -0,0 +1,81 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	PrometheusSourceKind        = "PrometheusSource"
+	ClusterPrometheusSourceKind = "ClusterPrometheusSource"
+)
+
+// PrometheusSourceSpec defines a prometheus endpoint which can be shared across rules
+type PrometheusSourceSpec struct {
+	PrometheusSpec `json:",inline"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:name="Address",type="string",JSONPath=".spec.address",description=""
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description=""
+
+// PrometheusSource is the Schema for the prometheussources API.
+// Secrets and configmaps are looked up in the namespace of the PrometheusSource.
+type PrometheusSource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec PrometheusSourceSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// PrometheusSourceList contains a list of PrometheusSource
+type PrometheusSourceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PrometheusSource `json:"items"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Address",type="string",JSONPath=".spec.address",description=""
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp",description=""
+
+// ClusterPrometheusSource is the Schema for the clusterprometheussources API.
+// Secrets and configmaps are looked up in the namespace the controller is running in.
+type ClusterPrometheusSource struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec PrometheusSourceSpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterPrometheusSourceList contains a list of ClusterPrometheusSource
+type ClusterPrometheusSourceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterPrometheusSource `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PrometheusSource{}, &PrometheusSourceList{})
+	SchemeBuilder.Register(&ClusterPrometheusSource{}, &ClusterPrometheusSourceList{})
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+// matchCondition returns the samples which match the condition of the rule and whether the rule is active.
+// Without a condition any sample activates the rule. Pending and firing rules are compared against the
+// deactivate threshold to implement hysteresis.
+func matchCondition(rule v1beta1.PrometheusPatchRule, samples model.Vector) (model.Vector, bool, error) {
+	condition := rule.Spec.Condition
+	if condition == nil {
+		return samples, len(samples) > 0, nil
+	}
+
+	threshold := condition.ActivateThreshold
+	if condition.DeactivateThreshold != nil && (rule.Status.State == v1beta1.StatePending || rule.Status.State == v1beta1.StateFiring) {
+		threshold = *condition.DeactivateThreshold
+	}
+
+	compare, err := compareFunc(condition.Operator)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var matched model.Vector
+	for _, sample := range samples {
+		value := float64(sample.Value)
+
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			switch condition.NonFinitePolicy {
+			case v1beta1.NonFinitePolicyMatch:
+				matched = append(matched, sample)
+			case v1beta1.NonFinitePolicyInactive:
+				return nil, false, nil
+			}
+
+			continue
+		}
+
+		if compare(value, threshold.AsApproximateFloat64()) {
+			matched = append(matched, sample)
+		}
+	}
+
+	minSamples := condition.MinSamples
+	if minSamples < 1 {
+		minSamples = 1
+	}
+
+	return matched, len(matched) >= minSamples, nil
+}
+
+func compareFunc(operator string) (func(a, b float64) bool, error) {
+	switch operator {
+	case ">":
+		return func(a, b float64) bool { return a > b }, nil
+	case ">=":
+		return func(a, b float64) bool { return a >= b }, nil
+	case "<":
+		return func(a, b float64) bool { return a < b }, nil
+	case "<=":
+		return func(a, b float64) bool { return a <= b }, nil
+	case "==":
+		return func(a, b float64) bool { return a == b }, nil
+	case "!=":
+		return func(a, b float64) bool { return a != b }, nil
+	default:
+		return nil, fmt.Errorf("unsupported condition operator %q", operator)
+	}
+}
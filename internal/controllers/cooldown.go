@@ -0,0 +1,61 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+// cooldownRemaining returns how long the cooldown of the rule is still in effect
+func cooldownRemaining(rule v1beta1.PrometheusPatchRule, now time.Time) time.Duration {
+	if rule.Spec.Cooldown == nil || rule.Status.LastChangeAt == nil {
+		return 0
+	}
+
+	remaining := rule.Status.LastChangeAt.Add(rule.Spec.Cooldown.Duration).Sub(now)
+	if remaining < 0 {
+		return 0
+	}
+
+	return remaining
+}
+
+// patchSetChanged returns whether applying the patches for the given samples changes the patch set in effect.
+// This is the case for the first application, if reverted patches are applied again after the rule started firing
+// or if a different tier became active.
+func patchSetChanged(rule v1beta1.PrometheusPatchRule, samples model.Vector) bool {
+	if rule.Status.LastChangeAt == nil {
+		return true
+	}
+
+	if rule.Spec.Revert && rule.Status.FiredAt != nil && rule.Status.LastChangeAt.Before(rule.Status.FiredAt) {
+		return true
+	}
+
+	var name string
+	if len(samples) > 0 {
+		if tier := selectTier(rule, samples[0]); tier != nil {
+			name = tier.Name
+		}
+	}
+
+	return name != rule.Status.ActiveTier
+}
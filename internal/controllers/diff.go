@@ -0,0 +1,46 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	jsonpatch "github.com/evanphx/json-patch"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// mergePatchDiff builds a JSON merge patch which transforms from into to.
+// Fields maintained by the api server are ignored.
+func mergePatchDiff(from, to *unstructured.Unstructured) ([]byte, error) {
+	before, err := diffableJSON(from)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := diffableJSON(to)
+	if err != nil {
+		return nil, err
+	}
+
+	return jsonpatch.CreateMergePatch(before, after)
+}
+
+func diffableJSON(obj *unstructured.Unstructured) ([]byte, error) {
+	obj = obj.DeepCopy()
+	obj.SetManagedFields(nil)
+	obj.SetResourceVersion("")
+	obj.SetGeneration(0)
+	return obj.MarshalJSON()
+}
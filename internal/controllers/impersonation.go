@@ -0,0 +1,82 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// targetClientCache holds the client used to patch the targets of each rule.
+// Building a client involves discovery, therefore clients are reused as long as the
+// impersonated service account and the kubeconfig of a rule do not change.
+type targetClientCache struct {
+	mu      sync.Mutex
+	clients map[string]cachedTargetClient
+}
+
+type cachedTargetClient struct {
+	identity string
+	client   client.Client
+}
+
+// get returns the cached client of the rule if it was built for the same identity
+func (c *targetClientCache) get(key, identity string) (client.Client, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.clients[key]
+	if !ok || cached.identity != identity {
+		return nil, false
+	}
+
+	return cached.client, true
+}
+
+func (c *targetClientCache) set(key, identity string, kubeClient client.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.clients == nil {
+		c.clients = make(map[string]cachedTargetClient)
+	}
+
+	c.clients[key] = cachedTargetClient{
+		identity: identity,
+		client:   kubeClient,
+	}
+}
+
+// delete drops the cached client of the rule
+func (c *targetClientCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.clients, key)
+}
+
+// impersonatingClient builds a client for the local cluster which impersonates the given service account
+func impersonatingClient(cfg *rest.Config, opts client.Options, namespace, serviceAccount string) (client.Client, error) {
+	cfg = rest.CopyConfig(cfg)
+	cfg.Impersonate = rest.ImpersonationConfig{
+		UserName: fmt.Sprintf("system:serviceaccount:%s:%s", namespace, serviceAccount),
+	}
+
+	return client.New(cfg, opts)
+}
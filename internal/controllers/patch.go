@@ -0,0 +1,313 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+// patchEntry is a single patch of a rule rendered for a query sample
+type patchEntry struct {
+	patchType string
+	index     int
+
+	// tier is the name of the tier the patch belongs to, empty for patches of the rule
+	tier string
+
+	target v1beta1.Selector
+	patch  client.Patch
+
+	// ops hold an operation for each path touched by the patch, they are used to take snapshots
+	ops []jsonPatchOperation
+
+	// manifest is the partial manifest of a server side apply patch
+	manifest map[string]interface{}
+}
+
+// object returns the object which is sent to the api server to patch the given item
+func (e patchEntry) object(item *unstructured.Unstructured) *unstructured.Unstructured {
+	if e.manifest == nil {
+		return item
+	}
+
+	obj := &unstructured.Unstructured{
+		Object: runtime.DeepCopyJSON(e.manifest),
+	}
+
+	obj.SetAPIVersion(item.GetAPIVersion())
+	obj.SetKind(item.GetKind())
+	obj.SetName(item.GetName())
+	obj.SetNamespace(item.GetNamespace())
+	return obj
+}
+
+// apply computes the patched object locally. If the result can not be computed locally false is returned
+// and the patch needs to be sent to the api server. Server side apply patches are never computed locally.
+func (e patchEntry) apply(item *unstructured.Unstructured) (*unstructured.Unstructured, bool) {
+	if e.manifest != nil {
+		return nil, false
+	}
+
+	doc, err := item.MarshalJSON()
+	if err != nil {
+		return nil, false
+	}
+
+	data, err := e.patch.Data(item)
+	if err != nil {
+		return nil, false
+	}
+
+	var patched []byte
+	switch e.patch.Type() {
+	case types.JSONPatchType:
+		var patch jsonpatch.Patch
+		patch, err = jsonpatch.DecodePatch(data)
+		if err == nil {
+			patched, err = patch.Apply(doc)
+		}
+	case types.MergePatchType:
+		patched, err = jsonpatch.MergePatch(doc, data)
+	case types.StrategicMergePatchType:
+		// The patch strategy is only known for built-in types
+		var typed runtime.Object
+		typed, err = clientgoscheme.Scheme.New(item.GroupVersionKind())
+		if err == nil {
+			patched, err = strategicpatch.StrategicMergePatch(doc, data, typed)
+		}
+	default:
+		return nil, false
+	}
+
+	if err != nil {
+		return nil, false
+	}
+
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(patched); err != nil {
+		return nil, false
+	}
+
+	return obj, true
+}
+
+// renderPatchEntries renders all patches of the rule using the given template data
+func renderPatchEntries(rule v1beta1.PrometheusPatchRule, data templateData) ([]patchEntry, error) {
+	var entries []patchEntry
+
+	for i, patch := range rule.Spec.JSON6902Patches {
+		target, err := renderSelector(patch.Target, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render target: %w", err)
+		}
+
+		ops, err := renderPatch(patch.Patch, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render patch: %w", err)
+		}
+
+		b, err := json.Marshal(ops)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, patchEntry{
+			patchType: v1beta1.PatchTypeJSON6902,
+			index:     i,
+			target:    target,
+			patch:     client.RawPatch(types.JSONPatchType, b),
+			ops:       ops,
+		})
+	}
+
+	for i, patch := range rule.Spec.ApplyPatches {
+		target, err := renderSelector(patch.Target, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render target: %w", err)
+		}
+
+		var manifest map[string]interface{}
+		if err := json.Unmarshal(patch.Patch.Raw, &manifest); err != nil || manifest == nil {
+			return nil, errors.New("invalid apply patch, must be an object")
+		}
+
+		entries = append(entries, patchEntry{
+			patchType: v1beta1.PatchTypeApply,
+			index:     i,
+			target:    target,
+			patch:     client.Apply,
+			manifest:  manifest,
+		})
+	}
+
+	mergePatches := []struct {
+		patchType string
+		raw       types.PatchType
+		patches   []v1beta1.MergePatch
+	}{
+		{v1beta1.PatchTypeStrategicMerge, types.StrategicMergePatchType, rule.Spec.StrategicMergePatches},
+		{v1beta1.PatchTypeMerge, types.MergePatchType, rule.Spec.MergePatches},
+	}
+
+	for _, list := range mergePatches {
+		for i, patch := range list.patches {
+			target, err := renderSelector(patch.Target, data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to render target: %w", err)
+			}
+
+			ops, err := mergePatchOperations(patch.Patch.Raw)
+			if err != nil {
+				return nil, err
+			}
+
+			entries = append(entries, patchEntry{
+				patchType: list.patchType,
+				index:     i,
+				target:    target,
+				patch:     client.RawPatch(list.raw, patch.Patch.Raw),
+				ops:       ops,
+			})
+		}
+	}
+
+	return entries, nil
+}
+
+// targetRecorder records the patch result of each target, at most max targets are recorded
+type targetRecorder struct {
+	previous []v1beta1.TargetStatus
+	targets  []v1beta1.TargetStatus
+	max      int
+
+	// succeeded is the number of targets which have been patched successfully (including dry runs)
+	succeeded int
+	dryRuns   int
+
+	// changed is the number of targets which have been changed and not rolled back
+	changed int
+}
+
+func newTargetRecorder(previous []v1beta1.TargetStatus, max int) *targetRecorder {
+	return &targetRecorder{
+		previous: previous,
+		max:      max,
+	}
+}
+
+// record records a failed patch
+func (t *targetRecorder) record(entry patchEntry, ref v1beta1.ResourceReference, err error) {
+	status := t.status(entry, ref, v1beta1.TargetResultFailed)
+	status.Error = err.Error()
+
+	// Keep the last successful apply from the previous evaluation
+	if previous := t.find(entry, ref); previous != nil {
+		status.LastAppliedTime = previous.LastAppliedTime
+		status.ResourceVersion = previous.ResourceVersion
+	}
+
+	t.add(status)
+}
+
+// applied records a successfully applied patch
+func (t *targetRecorder) applied(entry patchEntry, ref v1beta1.ResourceReference, resourceVersion string) {
+	t.succeeded++
+	t.changed++
+	now := metav1.Now()
+	status := t.status(entry, ref, v1beta1.TargetResultApplied)
+	status.LastAppliedTime = &now
+	status.ResourceVersion = resourceVersion
+	t.add(status)
+}
+
+// unchanged records a patch which did not change the target
+func (t *targetRecorder) unchanged(entry patchEntry, ref v1beta1.ResourceReference, resourceVersion string) {
+	t.succeeded++
+	status := t.status(entry, ref, v1beta1.TargetResultUnchanged)
+	status.LastAppliedTime = t.lastAppliedTime(entry, ref)
+	status.ResourceVersion = resourceVersion
+	t.add(status)
+}
+
+// dryRun records the diff of a dry run patch
+func (t *targetRecorder) dryRun(entry patchEntry, ref v1beta1.ResourceReference, diff string) {
+	t.succeeded++
+	t.dryRuns++
+	status := t.status(entry, ref, v1beta1.TargetResultDryRun)
+	status.Diff = diff
+	t.add(status)
+}
+
+// rolledBack marks all targets which have been applied during this evaluation as rolled back
+func (t *targetRecorder) rolledBack() {
+	t.changed = 0
+	for i, status := range t.targets {
+		if status.Result == v1beta1.TargetResultApplied {
+			t.targets[i].Result = v1beta1.TargetResultRolledBack
+		}
+	}
+}
+
+// lastAppliedTime returns the last time the patch was applied to the target during a previous evaluation
+func (t *targetRecorder) lastAppliedTime(entry patchEntry, ref v1beta1.ResourceReference) *metav1.Time {
+	if previous := t.find(entry, ref); previous != nil {
+		return previous.LastAppliedTime
+	}
+
+	return nil
+}
+
+func (t *targetRecorder) find(entry patchEntry, ref v1beta1.ResourceReference) *v1beta1.TargetStatus {
+	for i, previous := range t.previous {
+		if previous.ResourceReference == ref && previous.PatchType == entry.patchType && previous.PatchIndex == entry.index && previous.Tier == entry.tier {
+			return &t.previous[i]
+		}
+	}
+
+	return nil
+}
+
+func (t *targetRecorder) status(entry patchEntry, ref v1beta1.ResourceReference, result string) v1beta1.TargetStatus {
+	return v1beta1.TargetStatus{
+		ResourceReference: ref,
+		PatchType:         entry.patchType,
+		PatchIndex:        entry.index,
+		Tier:              entry.tier,
+		Result:            result,
+	}
+}
+
+func (t *targetRecorder) add(status v1beta1.TargetStatus) {
+	if t.max > 0 && len(t.targets) >= t.max {
+		return
+	}
+
+	t.targets = append(t.targets, status)
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+// These tests do not require envtest nor a prometheus instance, patches are applied using a fake client.
+
+// newFakeReconciler returns a reconciler patching the given objects using a fake client
+func newFakeReconciler(g *WithT, funcs interceptor.Funcs, objects ...client.Object) *PrometheusPatchRuleReconciler {
+	scheme := runtime.NewScheme()
+	g.Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+	g.Expect(v1beta1.AddToScheme(scheme)).To(Succeed())
+
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("ConfigMap"), apimeta.RESTScopeNamespace)
+
+	return &PrometheusPatchRuleReconciler{
+		Client:       fake.NewClientBuilder().WithScheme(scheme).WithRESTMapper(mapper).WithInterceptorFuncs(funcs).WithObjects(objects...).Build(),
+		FieldManager: "test",
+		Recorder:     record.NewFakeRecorder(10),
+	}
+}
+
+// dryRunPatch applies dry run patches in memory like the api server does, the fake client ignores them
+func dryRunPatch(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	patchOpts := &client.PatchOptions{}
+	patchOpts.ApplyOptions(opts)
+	if len(patchOpts.DryRun) == 0 {
+		return c.Patch(ctx, obj, patch, opts...)
+	}
+
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+
+	ops, err := jsonpatch.DecodePatch(data)
+	if err != nil {
+		return err
+	}
+
+	doc, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	patched, err := ops.Apply(doc)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(patched, obj)
+}
+
+func newConfigMap(name string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Data:       data,
+	}
+}
+
+func newAnnotationPatchRule(target string) v1beta1.PrometheusPatchRule {
+	return v1beta1.PrometheusPatchRule{
+		ObjectMeta: metav1.ObjectMeta{Name: "rule", Namespace: "default"},
+		Spec: v1beta1.PrometheusPatchRuleSpec{
+			JSON6902Patches: []v1beta1.JSON6902Patch{
+				{
+					Target: v1beta1.Selector{
+						Version:   "v1",
+						Kind:      "ConfigMap",
+						Name:      target,
+						Namespace: "default",
+					},
+					Patch: []v1beta1.JSONPatch{
+						{
+							OP:    "add",
+							Path:  "/metadata/annotations",
+							Value: extv1.JSON{Raw: []byte(`{"foo":"bar"}`)},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestApplyPatchesRecordsTargets(t *testing.T) {
+	g := NewWithT(t)
+	r := newFakeReconciler(g, interceptor.Funcs{}, newConfigMap("target", nil))
+
+	rule, _, err := r.applyPatches(context.Background(), newAnnotationPatchRule("target"), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(apimeta.IsStatusConditionTrue(rule.Status.Conditions, v1beta1.PatchAppliedCondition)).To(BeTrue())
+	g.Expect(rule.Status.Targets).To(HaveLen(1))
+	g.Expect(rule.Status.Targets[0].Name).To(Equal("target"))
+	g.Expect(rule.Status.Targets[0].PatchType).To(Equal(v1beta1.PatchTypeJSON6902))
+	g.Expect(rule.Status.Targets[0].Result).To(Equal(v1beta1.TargetResultApplied))
+	g.Expect(rule.Status.Targets[0].LastAppliedTime).NotTo(BeNil())
+
+	got := &corev1.ConfigMap{}
+	g.Expect(r.Client.Get(context.Background(), client.ObjectKey{Name: "target", Namespace: "default"}, got)).To(Succeed())
+	g.Expect(got.Annotations).To(HaveKeyWithValue("foo", "bar"))
+}
+
+func TestApplyPatchesRecordsFailedTargets(t *testing.T) {
+	g := NewWithT(t)
+	r := newFakeReconciler(g, interceptor.Funcs{})
+
+	rule, _, err := r.applyPatches(context.Background(), newAnnotationPatchRule("missing"), nil)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(rule.Status.Targets).To(HaveLen(1))
+	g.Expect(rule.Status.Targets[0].Name).To(Equal("missing"))
+	g.Expect(rule.Status.Targets[0].Result).To(Equal(v1beta1.TargetResultFailed))
+	g.Expect(rule.Status.Targets[0].Error).NotTo(BeEmpty())
+}
+
+func TestApplyPatchesRecordsDryRunDiff(t *testing.T) {
+	g := NewWithT(t)
+	r := newFakeReconciler(g, interceptor.Funcs{Patch: dryRunPatch}, newConfigMap("target", nil))
+
+	rule := newAnnotationPatchRule("target")
+	rule.Spec.DryRun = true
+
+	rule, _, err := r.applyPatches(context.Background(), rule, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(apimeta.FindStatusCondition(rule.Status.Conditions, v1beta1.PatchAppliedCondition).Reason).To(Equal(v1beta1.DryRunReason))
+	g.Expect(rule.Status.Targets).To(HaveLen(1))
+	g.Expect(rule.Status.Targets[0].Result).To(Equal(v1beta1.TargetResultDryRun))
+	g.Expect(rule.Status.Targets[0].Diff).To(Equal(`{"metadata":{"annotations":{"foo":"bar"}}}`))
+
+	got := &corev1.ConfigMap{}
+	g.Expect(r.Client.Get(context.Background(), client.ObjectKey{Name: "target", Namespace: "default"}, got)).To(Succeed())
+	g.Expect(got.Annotations).NotTo(HaveKey("foo"))
+}
+
+func TestApplyPatchesRecordsUnchangedTargets(t *testing.T) {
+	g := NewWithT(t)
+
+	var patches int
+	r := newFakeReconciler(g, interceptor.Funcs{
+		Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+			patches++
+			return c.Patch(ctx, obj, patch, opts...)
+		},
+	}, newConfigMap("target", nil))
+
+	rule, _, err := r.applyPatches(context.Background(), newAnnotationPatchRule("target"), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(patches).To(Equal(1))
+	lastAppliedTime := rule.Status.Targets[0].LastAppliedTime
+
+	rule, _, err = r.applyPatches(context.Background(), rule, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(patches).To(Equal(1))
+	g.Expect(rule.Status.Targets).To(HaveLen(1))
+	g.Expect(rule.Status.Targets[0].Result).To(Equal(v1beta1.TargetResultUnchanged))
+	g.Expect(rule.Status.Targets[0].LastAppliedTime).To(Equal(lastAppliedTime))
+}
+
+func TestApplyPatchesCountsChangedTargets(t *testing.T) {
+	g := NewWithT(t)
+	r := newFakeReconciler(g, interceptor.Funcs{}, newConfigMap("target", nil))
+
+	rule := newAnnotationPatchRule("target")
+	rule.Spec.FailurePolicy = v1beta1.FailurePolicyContinue
+	missing := newAnnotationPatchRule("missing").Spec.JSON6902Patches[0]
+	rule.Spec.JSON6902Patches = append(rule.Spec.JSON6902Patches, missing)
+
+	rule, targets, err := r.applyPatches(context.Background(), rule, nil)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(targets.changed).To(Equal(1))
+
+	_, targets, err = r.applyPatches(context.Background(), rule, nil)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(targets.changed).To(BeZero())
+}
+
+func TestApplyPatchesDoesNotCountRolledBackTargets(t *testing.T) {
+	g := NewWithT(t)
+	r := newFakeReconciler(g, interceptor.Funcs{}, newConfigMap("target", nil))
+
+	rule := newAnnotationPatchRule("target")
+	rule.Spec.Atomic = true
+	missing := newAnnotationPatchRule("missing").Spec.JSON6902Patches[0]
+	rule.Spec.JSON6902Patches = append(rule.Spec.JSON6902Patches, missing)
+
+	rule, targets, err := r.applyPatches(context.Background(), rule, nil)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(targets.changed).To(BeZero())
+	g.Expect(rule.Status.Targets[0].Result).To(Equal(v1beta1.TargetResultRolledBack))
+}
+
+func TestApplyPatchesRecordsTheTier(t *testing.T) {
+	g := NewWithT(t)
+	r := newFakeReconciler(g, interceptor.Funcs{}, newConfigMap("target", nil))
+
+	two := resource.MustParse("2")
+	rule := newAnnotationPatchRule("target")
+	rule.Spec.Tiers = []v1beta1.Tier{
+		{Name: "low", Max: &two},
+		{Name: "high", Min: &two, JSON6902Patches: rule.Spec.JSON6902Patches},
+	}
+	rule.Spec.JSON6902Patches = nil
+
+	rule, _, err := r.applyPatches(context.Background(), rule, model.Vector{{Value: 3}})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rule.Status.ActiveTier).To(Equal("high"))
+	g.Expect(rule.Status.Targets).To(HaveLen(1))
+	g.Expect(rule.Status.Targets[0].Tier).To(Equal("high"))
+	g.Expect(rule.Status.Targets[0].PatchIndex).To(Equal(0))
+	g.Expect(rule.Status.Targets[0].Result).To(Equal(v1beta1.TargetResultApplied))
+}
@@ -0,0 +1,429 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	"github.com/prometheus/common/config"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+// prometheusConfig is the prometheus connection configuration with all secret references resolved
+type prometheusConfig struct {
+	Address     string
+	Timeout     time.Duration
+	BearerToken string
+	Username    string
+	Password    string
+	TLS         *tlsConfig
+	Headers     http.Header
+}
+
+type tlsConfig struct {
+	CA                 []byte
+	Cert               []byte
+	Key                []byte
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// checksum identifies a configuration, a changed checksum invalidates cached clients
+func (c *prometheusConfig) checksum() (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// roundTripper builds the http.RoundTripper used to query prometheus
+func (c *prometheusConfig) roundTripper() (http.RoundTripper, error) {
+	rt := api.DefaultRoundTripper.(*http.Transport).Clone()
+
+	if c.TLS != nil {
+		tlsConfig, err := c.TLS.build()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build tls config: %w", err)
+		}
+
+		rt.TLSClientConfig = tlsConfig
+	}
+
+	var wrapped http.RoundTripper = rt
+	switch {
+	case c.BearerToken != "":
+		wrapped = config.NewAuthorizationCredentialsRoundTripper("Bearer", config.Secret(c.BearerToken), wrapped)
+	case c.Username != "" || c.Password != "":
+		wrapped = config.NewBasicAuthRoundTripper(c.Username, config.Secret(c.Password), "", wrapped)
+	}
+
+	if len(c.Headers) > 0 {
+		wrapped = &headerRoundTripper{headers: c.Headers, rt: wrapped}
+	}
+
+	return wrapped, nil
+}
+
+func (c *tlsConfig) build() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+	}
+
+	if len(c.CA) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(c.CA) {
+			return nil, errors.New("ca does not contain any valid PEM certificate")
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(c.Cert) > 0 {
+		keyPair, err := tls.X509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+
+	return tlsConfig, nil
+}
+
+// headerRoundTripper injects static headers into each request
+type headerRoundTripper struct {
+	headers http.Header
+	rt      http.RoundTripper
+}
+
+func (h *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, values := range h.headers {
+		req.Header[key] = values
+	}
+
+	return h.rt.RoundTrip(req)
+}
+
+func (h *headerRoundTripper) CloseIdleConnections() {
+	if rt, ok := h.rt.(closeIdler); ok {
+		rt.CloseIdleConnections()
+	}
+}
+
+type closeIdler interface {
+	CloseIdleConnections()
+}
+
+// clientCache holds one prometheus client per source
+type clientCache struct {
+	mu      sync.Mutex
+	clients map[string]cachedClient
+}
+
+type cachedClient struct {
+	checksum string
+	client   api.Client
+	rt       http.RoundTripper
+}
+
+// get returns the cached client for the given key or creates a new one if there is none
+// or the configuration changed in the meantime.
+func (c *clientCache) get(key string, cfg *prometheusConfig) (api.Client, error) {
+	checksum, err := cfg.checksum()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.clients[key]; ok && cached.checksum == checksum {
+		return cached.client, nil
+	}
+
+	rt, err := cfg.roundTripper()
+	if err != nil {
+		return nil, err
+	}
+
+	promClient, err := api.NewClient(api.Config{
+		Address:      cfg.Address,
+		RoundTripper: rt,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.remove(key)
+	if c.clients == nil {
+		c.clients = make(map[string]cachedClient)
+	}
+
+	c.clients[key] = cachedClient{
+		checksum: checksum,
+		client:   promClient,
+		rt:       rt,
+	}
+
+	return promClient, nil
+}
+
+// delete drops the cached client for the given key
+func (c *clientCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(key)
+}
+
+func (c *clientCache) remove(key string) {
+	if cached, ok := c.clients[key]; ok {
+		if rt, ok := cached.rt.(closeIdler); ok {
+			rt.CloseIdleConnections()
+		}
+
+		delete(c.clients, key)
+	}
+}
+
+// prometheusSource resolves the prometheus spec of a rule.
+// It returns the spec, the namespace used to look up referenced secrets and a key which identifies the source.
+func (r *PrometheusPatchRuleReconciler) prometheusSource(ctx context.Context, rule v1beta1.PrometheusPatchRule) (v1beta1.PrometheusSpec, string, string, error) {
+	if rule.Spec.PrometheusRef == nil {
+		key := prometheusSourceKey(v1beta1.PrometheusPatchRuleKind, rule.Namespace, rule.Name)
+		return rule.Spec.Prometheus, rule.Namespace, key, nil
+	}
+
+	switch rule.Spec.PrometheusRef.Kind {
+	case v1beta1.PrometheusSourceKind, "":
+		source := &v1beta1.PrometheusSource{}
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: rule.Spec.PrometheusRef.Name, Namespace: rule.Namespace}, source); err != nil {
+			return v1beta1.PrometheusSpec{}, "", "", err
+		}
+
+		key := prometheusSourceKey(v1beta1.PrometheusSourceKind, source.Namespace, source.Name)
+		return source.Spec.PrometheusSpec, source.Namespace, key, nil
+	case v1beta1.ClusterPrometheusSourceKind:
+		source := &v1beta1.ClusterPrometheusSource{}
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: rule.Spec.PrometheusRef.Name}, source); err != nil {
+			return v1beta1.PrometheusSpec{}, "", "", err
+		}
+
+		key := prometheusSourceKey(v1beta1.ClusterPrometheusSourceKind, "", source.Name)
+		return source.Spec.PrometheusSpec, r.RuntimeNamespace, key, nil
+	default:
+		return v1beta1.PrometheusSpec{}, "", "", fmt.Errorf("unsupported prometheusRef kind %s", rule.Spec.PrometheusRef.Kind)
+	}
+}
+
+// prometheusSourceKey builds the key of the cached client of a prometheus spec
+func prometheusSourceKey(kind, namespace, name string) string {
+	if namespace == "" {
+		return fmt.Sprintf("%s/%s", kind, name)
+	}
+
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
+
+// prometheusConfig resolves all secret and configmap references of the given spec.
+// Any secrets or configmaps are looked up in the given namespace.
+func (r *PrometheusPatchRuleReconciler) prometheusConfig(ctx context.Context, spec v1beta1.PrometheusSpec, namespace string) (*prometheusConfig, error) {
+	if spec.Address == "" {
+		return nil, errors.New("no prometheus address specified")
+	}
+
+	cfg := &prometheusConfig{
+		Address: spec.Address,
+	}
+
+	if spec.Timeout != nil {
+		cfg.Timeout = spec.Timeout.Duration
+	}
+
+	switch {
+	case spec.BearerTokenSecret != nil && spec.BasicAuth != nil:
+		return nil, errors.New("bearerTokenSecret and basicAuth are mutually exclusive")
+	case spec.BearerTokenSecret != nil:
+		token, err := r.secretValue(ctx, namespace, *spec.BearerTokenSecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get bearer token: %w", err)
+		}
+
+		cfg.BearerToken = strings.TrimSpace(string(token))
+	case spec.BasicAuth != nil:
+		username, err := r.secretValue(ctx, namespace, spec.BasicAuth.Username)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get basic auth username: %w", err)
+		}
+
+		password, err := r.secretValue(ctx, namespace, spec.BasicAuth.Password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get basic auth password: %w", err)
+		}
+
+		cfg.Username = strings.TrimSpace(string(username))
+		cfg.Password = strings.TrimSpace(string(password))
+	}
+
+	if spec.TLSConfig != nil {
+		tlsConfig, err := r.tlsConfig(ctx, *spec.TLSConfig, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build tls config: %w", err)
+		}
+
+		// Validate the certificates early so the cache only ever fails on invalid addresses
+		if _, err := tlsConfig.build(); err != nil {
+			return nil, fmt.Errorf("failed to build tls config: %w", err)
+		}
+
+		cfg.TLS = tlsConfig
+	}
+
+	if len(spec.Headers) > 0 {
+		headers, err := r.headers(ctx, spec.Headers, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build headers: %w", err)
+		}
+
+		cfg.Headers = headers
+	}
+
+	return cfg, nil
+}
+
+func (r *PrometheusPatchRuleReconciler) headers(ctx context.Context, spec map[string]v1beta1.HeaderValue, namespace string) (http.Header, error) {
+	headers := make(http.Header, len(spec))
+	for name, header := range spec {
+		switch {
+		case header.SecretKeyRef != nil && header.Value != "":
+			return nil, fmt.Errorf("header %s: value and secretKeyRef are mutually exclusive", name)
+		case header.SecretKeyRef != nil:
+			value, err := r.secretValue(ctx, namespace, *header.SecretKeyRef)
+			if err != nil {
+				return nil, fmt.Errorf("header %s: %w", name, err)
+			}
+
+			headers.Set(name, strings.TrimSpace(string(value)))
+		default:
+			headers.Set(name, header.Value)
+		}
+	}
+
+	return headers, nil
+}
+
+func (r *PrometheusPatchRuleReconciler) tlsConfig(ctx context.Context, spec v1beta1.TLSConfig, namespace string) (*tlsConfig, error) {
+	cfg := &tlsConfig{
+		InsecureSkipVerify: spec.InsecureSkipVerify,
+		ServerName:         spec.ServerName,
+	}
+
+	if spec.CA != nil {
+		ca, err := r.secretOrConfigMapValue(ctx, namespace, *spec.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get ca: %w", err)
+		}
+
+		cfg.CA = ca
+	}
+
+	switch {
+	case spec.Cert != nil && spec.KeySecret != nil:
+		cert, err := r.secretOrConfigMapValue(ctx, namespace, *spec.Cert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get client certificate: %w", err)
+		}
+
+		key, err := r.secretValue(ctx, namespace, *spec.KeySecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get client key: %w", err)
+		}
+
+		cfg.Cert = cert
+		cfg.Key = key
+	case spec.Cert != nil:
+		return nil, errors.New("client certificate specified without keySecret")
+	case spec.KeySecret != nil:
+		return nil, errors.New("keySecret specified without client certificate")
+	}
+
+	return cfg, nil
+}
+
+func (r *PrometheusPatchRuleReconciler) secretOrConfigMapValue(ctx context.Context, namespace string, ref v1beta1.SecretOrConfigMap) ([]byte, error) {
+	switch {
+	case ref.Secret != nil && ref.ConfigMap != nil:
+		return nil, errors.New("secret and configMap are mutually exclusive")
+	case ref.Secret != nil:
+		return r.secretValue(ctx, namespace, *ref.Secret)
+	case ref.ConfigMap != nil:
+		return r.configMapValue(ctx, namespace, *ref.ConfigMap)
+	default:
+		return nil, errors.New("either secret or configMap must be specified")
+	}
+}
+
+func (r *PrometheusPatchRuleReconciler) secretValue(ctx context.Context, namespace string, selector corev1.SecretKeySelector) ([]byte, error) {
+	secret := &corev1.Secret{}
+	if err := r.Client.Get(ctx, client.ObjectKey{Name: selector.Name, Namespace: namespace}, secret); err != nil {
+		return nil, err
+	}
+
+	value, ok := secret.Data[selector.Key]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in secret %s", selector.Key, selector.Name)
+	}
+
+	return value, nil
+}
+
+func (r *PrometheusPatchRuleReconciler) configMapValue(ctx context.Context, namespace string, selector corev1.ConfigMapKeySelector) ([]byte, error) {
+	configMap := &corev1.ConfigMap{}
+	if err := r.Client.Get(ctx, client.ObjectKey{Name: selector.Name, Namespace: namespace}, configMap); err != nil {
+		return nil, err
+	}
+
+	if value, ok := configMap.Data[selector.Key]; ok {
+		return []byte(value), nil
+	}
+
+	if value, ok := configMap.BinaryData[selector.Key]; ok {
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("key %s not found in configmap %s", selector.Key, selector.Name)
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+// newPrometheusTestServer returns a reconciler reading the prometheus credentials using a fake client
+// and a server recording the headers of the last request
+func newPrometheusTestServer(t *testing.T, g *WithT) (*PrometheusPatchRuleReconciler, *httptest.Server, *http.Header) {
+	reconciler := newFakeReconciler(g, interceptor.Funcs{},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "prometheus-credentials", Namespace: "default"},
+			Data: map[string][]byte{
+				"token":    []byte("secret-token\n"),
+				"username": []byte("user"),
+				"password": []byte("pass\n"),
+				"tenant":   []byte("tenant-b\n"),
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "prometheus-ca", Namespace: "default"},
+			Data: map[string]string{
+				"ca.crt": "not a certificate",
+			},
+		},
+	)
+
+	received := &http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*received = r.Header.Clone()
+	}))
+	t.Cleanup(server.Close)
+
+	return reconciler, server, received
+}
+
+func prometheusSecretKey(key string) corev1.SecretKeySelector {
+	return corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "prometheus-credentials"},
+		Key:                  key,
+	}
+}
+
+// sendPrometheusRequest sends a request to the test server using the round tripper built from the given spec
+func sendPrometheusRequest(t *testing.T, spec v1beta1.PrometheusSpec) http.Header {
+	g := NewWithT(t)
+	reconciler, server, received := newPrometheusTestServer(t, g)
+
+	spec.Address = server.URL
+	cfg, err := reconciler.prometheusConfig(context.Background(), spec, "default")
+	g.Expect(err).NotTo(HaveOccurred())
+
+	rt, err := cfg.roundTripper()
+	g.Expect(err).NotTo(HaveOccurred())
+
+	res, err := (&http.Client{Transport: rt}).Get(server.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(res.Body.Close()).To(Succeed())
+
+	return *received
+}
+
+// prometheusConfigError returns the error building the prometheus config from the given spec
+func prometheusConfigError(t *testing.T, spec v1beta1.PrometheusSpec) error {
+	g := NewWithT(t)
+	reconciler, server, _ := newPrometheusTestServer(t, g)
+
+	spec.Address = server.URL
+	_, err := reconciler.prometheusConfig(context.Background(), spec, "default")
+	return err
+}
+
+func TestPrometheusBearerToken(t *testing.T) {
+	g := NewWithT(t)
+	token := prometheusSecretKey("token")
+	header := sendPrometheusRequest(t, v1beta1.PrometheusSpec{
+		BearerTokenSecret: &token,
+	})
+
+	g.Expect(header.Get("Authorization")).To(Equal("Bearer secret-token"))
+}
+
+func TestPrometheusBasicAuth(t *testing.T) {
+	g := NewWithT(t)
+	header := sendPrometheusRequest(t, v1beta1.PrometheusSpec{
+		BasicAuth: &v1beta1.BasicAuth{
+			Username: prometheusSecretKey("username"),
+			Password: prometheusSecretKey("password"),
+		},
+	})
+
+	username, password, ok := (&http.Request{Header: header}).BasicAuth()
+	g.Expect(ok).To(BeTrue())
+	g.Expect(username).To(Equal("user"))
+	g.Expect(password).To(Equal("pass"))
+}
+
+func TestPrometheusWithoutCredentials(t *testing.T) {
+	g := NewWithT(t)
+	header := sendPrometheusRequest(t, v1beta1.PrometheusSpec{})
+	g.Expect(header.Get("Authorization")).To(BeEmpty())
+}
+
+func TestPrometheusBearerTokenAndBasicAuth(t *testing.T) {
+	g := NewWithT(t)
+	token := prometheusSecretKey("token")
+	err := prometheusConfigError(t, v1beta1.PrometheusSpec{
+		BearerTokenSecret: &token,
+		BasicAuth: &v1beta1.BasicAuth{
+			Username: prometheusSecretKey("username"),
+			Password: prometheusSecretKey("password"),
+		},
+	})
+
+	g.Expect(err).To(MatchError(ContainSubstring("mutually exclusive")))
+}
+
+func TestPrometheusInvalidCA(t *testing.T) {
+	g := NewWithT(t)
+	err := prometheusConfigError(t, v1beta1.PrometheusSpec{
+		TLSConfig: &v1beta1.TLSConfig{
+			CA: &v1beta1.SecretOrConfigMap{
+				ConfigMap: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "prometheus-ca"},
+					Key:                  "ca.crt",
+				},
+			},
+		},
+	})
+
+	g.Expect(err).To(MatchError(ContainSubstring("ca does not contain any valid PEM certificate")))
+}
+
+func TestPrometheusCertificateWithoutKey(t *testing.T) {
+	g := NewWithT(t)
+	cert := prometheusSecretKey("token")
+	err := prometheusConfigError(t, v1beta1.PrometheusSpec{
+		TLSConfig: &v1beta1.TLSConfig{
+			Cert: &v1beta1.SecretOrConfigMap{
+				Secret: &cert,
+			},
+		},
+	})
+
+	g.Expect(err).To(MatchError(ContainSubstring("client certificate specified without keySecret")))
+}
+
+func TestPrometheusStaticHeaders(t *testing.T) {
+	g := NewWithT(t)
+	header := sendPrometheusRequest(t, v1beta1.PrometheusSpec{
+		Headers: map[string]v1beta1.HeaderValue{
+			"X-Scope-OrgID": {Value: "tenant-a"},
+		},
+	})
+
+	g.Expect(header.Get("X-Scope-OrgID")).To(Equal("tenant-a"))
+}
+
+func TestPrometheusSecretHeaders(t *testing.T) {
+	g := NewWithT(t)
+	tenant := prometheusSecretKey("tenant")
+	header := sendPrometheusRequest(t, v1beta1.PrometheusSpec{
+		Headers: map[string]v1beta1.HeaderValue{
+			"X-Scope-OrgID": {SecretKeyRef: &tenant},
+		},
+	})
+
+	g.Expect(header.Get("X-Scope-OrgID")).To(Equal("tenant-b"))
+}
+
+func TestPrometheusHeaderValueAndSecret(t *testing.T) {
+	g := NewWithT(t)
+	tenant := prometheusSecretKey("tenant")
+	err := prometheusConfigError(t, v1beta1.PrometheusSpec{
+		Headers: map[string]v1beta1.HeaderValue{
+			"X-Scope-OrgID": {Value: "tenant-a", SecretKeyRef: &tenant},
+		},
+	})
+
+	g.Expect(err).To(MatchError(ContainSubstring("value and secretKeyRef are mutually exclusive")))
+}
+
+func TestPrometheusClientOfDeletedSource(t *testing.T) {
+	g := NewWithT(t)
+	reconciler, server, _ := newPrometheusTestServer(t, g)
+
+	key := prometheusSourceKey(v1beta1.PrometheusSourceKind, "default", "deleted")
+	_, err := reconciler.clients.get(key, &prometheusConfig{Address: server.URL})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(reconciler.clients.clients).To(HaveKey(key))
+
+	reconciler.requestsForPrometheusSource(v1beta1.PrometheusSourceKind)(context.Background(), &v1beta1.PrometheusSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "deleted", Namespace: "default"},
+	})
+
+	g.Expect(reconciler.clients.clients).NotTo(HaveKey(key))
+}
@@ -23,10 +23,11 @@ import (
 	"fmt"
 	"time"
 
+	fluxclient "github.com/fluxcd/pkg/runtime/client"
 	"github.com/go-logr/logr"
-	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
+	corev1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -35,10 +36,16 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/cli-utils/pkg/kstatus/polling"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
@@ -48,6 +55,19 @@ import (
 //+kubebuilder:rbac:groups=metrics.infra.doodle.com,resources=prometheuspatchrules/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=metrics.infra.doodle.com,resources=prometheuspatchrules/finalizers,verbs=update
 //+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=metrics.infra.doodle.com,resources=prometheussources;clusterprometheussources,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets;configmaps,verbs=get
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;impersonate
+
+const (
+	prometheusRefIndex = ".spec.prometheusRef"
+)
+
+var (
+	errMissingTargetKind     = errors.New("target requires either kind or resource")
+	errServiceAccountMissing = errors.New("service account not found")
+)
 
 // PatchPrometheusPatchRuleReconciler reconciles a PrometheusPatchRule object
 type PrometheusPatchRuleReconciler struct {
@@ -56,6 +76,27 @@ type PrometheusPatchRuleReconciler struct {
 	Log          logr.Logger
 	Recorder     record.EventRecorder
 	Scheme       *runtime.Scheme
+
+	// RuntimeNamespace is the namespace in which secrets and configmaps
+	// referenced by a ClusterPrometheusSource are looked up.
+	RuntimeNamespace string
+
+	// DryRun enforces dry run mode for all rules
+	DryRun bool
+
+	// MaxStatusTargets is the maximum number of targets recorded in the status of a rule
+	MaxStatusTargets int
+
+	// KubeConfigOpts are the options applied to kubeconfigs of remote clusters
+	KubeConfigOpts fluxclient.KubeConfigOptions
+
+	// DefaultServiceAccount is impersonated for rules which do not specify a service account
+	DefaultServiceAccount string
+
+	clients       clientCache
+	targetClients targetClientCache
+	restConfig    *rest.Config
+	watcher       *targetWatcher
 }
 
 // PodReconcilerOptions
@@ -65,10 +106,87 @@ type PrometheusPatchRuleReconcilerOptions struct {
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *PrometheusPatchRuleReconciler) SetupWithManager(mgr ctrl.Manager, opts PrometheusPatchRuleReconcilerOptions) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&v1beta1.PrometheusPatchRule{}).
+	// Index the PrometheusPatchRules by the referenced prometheus source
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &v1beta1.PrometheusPatchRule{}, prometheusRefIndex,
+		func(o client.Object) []string {
+			rule := o.(*v1beta1.PrometheusPatchRule)
+			if rule.Spec.PrometheusRef == nil {
+				return nil
+			}
+
+			kind := rule.Spec.PrometheusRef.Kind
+			if kind == "" {
+				kind = v1beta1.PrometheusSourceKind
+			}
+
+			return []string{fmt.Sprintf("%s/%s", kind, rule.Spec.PrometheusRef.Name)}
+		},
+	); err != nil {
+		return err
+	}
+
+	// Index the PrometheusPatchRules by their targets to enforce patches
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &v1beta1.PrometheusPatchRule{}, targetIndex, indexTargets); err != nil {
+		return err
+	}
+
+	r.restConfig = mgr.GetConfig()
+
+	c, err := ctrl.NewControllerManagedBy(mgr).
+		// Status updates (for example status.lastEvaluation) must not trigger another evaluation
+		For(&v1beta1.PrometheusPatchRule{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(
+			&v1beta1.PrometheusSource{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForPrometheusSource(v1beta1.PrometheusSourceKind)),
+		).
+		Watches(
+			&v1beta1.ClusterPrometheusSource{},
+			handler.EnqueueRequestsFromMapFunc(r.requestsForPrometheusSource(v1beta1.ClusterPrometheusSourceKind)),
+		).
 		WithOptions(controller.Options{MaxConcurrentReconciles: opts.MaxConcurrentReconciles}).
-		Complete(r)
+		Build(r)
+	if err != nil {
+		return err
+	}
+
+	r.watcher = &targetWatcher{
+		controller: c,
+		cache:      mgr.GetCache(),
+		handler:    handler.EnqueueRequestsFromMapFunc(r.requestsForTarget),
+	}
+
+	return nil
+}
+
+func (r *PrometheusPatchRuleReconciler) requestsForPrometheusSource(kind string) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		// Drop the cached prometheus client of a deleted source
+		if err := r.Client.Get(ctx, client.ObjectKeyFromObject(obj), obj.DeepCopyObject().(client.Object)); kerrors.IsNotFound(err) {
+			r.clients.delete(prometheusSourceKey(kind, obj.GetNamespace(), obj.GetName()))
+		}
+
+		var list v1beta1.PrometheusPatchRuleList
+		if err := r.List(ctx, &list, client.InNamespace(obj.GetNamespace()), client.MatchingFields{
+			prometheusRefIndex: fmt.Sprintf("%s/%s", kind, obj.GetName()),
+		}); err != nil {
+			return nil
+		}
+
+		var reqs []reconcile.Request
+		for _, rule := range list.Items {
+			r.Log.Info("referenced prometheus source changed, requeuing rule", "namespace", rule.GetNamespace(), "name", rule.GetName())
+			reqs = append(reqs, reconcile.Request{NamespacedName: objectKey(&rule)})
+		}
+
+		return reqs
+	}
+}
+
+func objectKey(object metav1.Object) types.NamespacedName {
+	return types.NamespacedName{
+		Namespace: object.GetNamespace(),
+		Name:      object.GetName(),
+	}
 }
 
 // Reconcile PrometheusPatchRule
@@ -85,6 +203,8 @@ func (r *PrometheusPatchRuleReconciler) Reconcile(ctx context.Context, req ctrl.
 			// Request object not found, could have been deleted after reconcile request.
 			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
 			// Return and don't requeue
+			r.clients.delete(prometheusSourceKey(v1beta1.PrometheusPatchRuleKind, req.Namespace, req.Name))
+			r.targetClients.delete(req.String())
 			return reconcile.Result{}, nil
 		}
 		// Error reading the object - requeue the request.
@@ -110,10 +230,75 @@ func (r *PrometheusPatchRuleReconciler) Reconcile(ctx context.Context, req ctrl.
 }
 
 func (r *PrometheusPatchRuleReconciler) reconcile(ctx context.Context, rule v1beta1.PrometheusPatchRule, logger logr.Logger) (v1beta1.PrometheusPatchRule, ctrl.Result, error) {
-	client, err := api.NewClient(api.Config{
-		Address: rule.Spec.Prometheus.Address,
-	})
+	// A changed spec (for example expr or for) restarts the state machine
+	if rule.Status.ObservedGeneration != rule.Generation {
+		rule.Status.ObservedGeneration = rule.Generation
+		rule = resetState(rule)
+	}
 
+	now := time.Now()
+	requeueAfter := rule.Spec.Interval.Duration
+
+	// During a blackout the targets must not be changed at all, the state of the rule is kept as is
+	blackout, end, err := activeBlackout(rule, now)
+	if err != nil {
+		err = fmt.Errorf("failed to evaluate blackouts: %w", err)
+		rule = v1beta1.PrometheusPatchRuleNotActive(rule, v1beta1.InvalidScheduleReason, err.Error())
+		return rule, ctrl.Result{}, err
+	}
+
+	if blackout != nil {
+		msg := fmt.Sprintf("blackout %s is in effect", blackout.Name)
+		if !end.IsZero() {
+			msg = fmt.Sprintf("%s until %s", msg, end.Format(time.RFC3339))
+			requeueAfter = minDuration(requeueAfter, end.Sub(now))
+		}
+
+		rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.OutsideScheduleReason, msg)
+		return rule, ctrl.Result{RequeueAfter: requeueAfter}, nil
+	}
+
+	scheduled, next, err := inSchedule(rule, now)
+	if err != nil {
+		err = fmt.Errorf("failed to evaluate schedule: %w", err)
+		rule = v1beta1.PrometheusPatchRuleNotActive(rule, v1beta1.InvalidScheduleReason, err.Error())
+		return rule, ctrl.Result{}, err
+	}
+
+	if !scheduled {
+		msg := "outside of schedule"
+		if !next.IsZero() {
+			msg = fmt.Sprintf("%s, next window starts at %s", msg, next.Format(time.RFC3339))
+			requeueAfter = minDuration(requeueAfter, next.Sub(now))
+		}
+
+		rule = resetState(rule)
+		rule = v1beta1.PrometheusPatchRuleNotActive(rule, v1beta1.OutsideScheduleReason, msg)
+
+		var remaining time.Duration
+		rule, remaining, err = r.deactivate(ctx, rule, now)
+		if remaining > 0 {
+			requeueAfter = minDuration(requeueAfter, remaining)
+		}
+
+		return rule, ctrl.Result{RequeueAfter: requeueAfter}, err
+	}
+
+	spec, namespace, key, err := r.prometheusSource(ctx, rule)
+	if err != nil {
+		err = fmt.Errorf("failed to get prometheus source: %w", err)
+		rule = v1beta1.PrometheusPatchRuleNotActive(rule, v1beta1.InvalidPrometheusConfigReason, err.Error())
+		return rule, ctrl.Result{}, err
+	}
+
+	cfg, err := r.prometheusConfig(ctx, spec, namespace)
+	if err != nil {
+		err = fmt.Errorf("failed to configure prometheus client: %w", err)
+		rule = v1beta1.PrometheusPatchRuleNotActive(rule, v1beta1.InvalidPrometheusConfigReason, err.Error())
+		return rule, ctrl.Result{}, err
+	}
+
+	client, err := r.clients.get(key, cfg)
 	if err != nil {
 		err = fmt.Errorf("failed parse prometheus address: %w", err)
 		rule = v1beta1.PrometheusPatchRuleNotActive(rule, v1beta1.InvalidPrometheusURLReason, err.Error())
@@ -121,7 +306,12 @@ func (r *PrometheusPatchRuleReconciler) reconcile(ctx context.Context, rule v1be
 	}
 
 	v1api := v1.NewAPI(client)
-	result, warnings, err := v1api.Query(ctx, rule.Spec.Expr, time.Now())
+	var queryOpts []v1.Option
+	if cfg.Timeout > 0 {
+		queryOpts = append(queryOpts, v1.WithTimeout(cfg.Timeout))
+	}
+
+	result, warnings, err := v1api.Query(ctx, rule.Spec.Expr, now, queryOpts...)
 	if err != nil {
 		err = fmt.Errorf("failed executing prometheus query: %w", err)
 		rule = v1beta1.PrometheusPatchRuleNotActive(rule, v1beta1.PrometheusQueryFailedReason, err.Error())
@@ -139,113 +329,690 @@ func (r *PrometheusPatchRuleReconciler) reconcile(ctx context.Context, rule v1be
 		return rule, ctrl.Result{}, err
 	}
 
-	if len(value) > 0 {
+	samples, active, err := matchCondition(rule, value)
+	if err != nil {
+		err = fmt.Errorf("failed to evaluate condition: %w", err)
+		rule = v1beta1.PrometheusPatchRuleNotActive(rule, v1beta1.FailedReason, err.Error())
+		return rule, ctrl.Result{}, err
+	}
+
+	rule = evaluateState(rule, active, now)
+
+	switch {
+	case rule.Status.State == v1beta1.StateInactive:
+		msg := "query did not return samples"
+		if len(value) > 0 {
+			msg = fmt.Sprintf("%d of %d query samples match the condition", len(samples), len(value))
+		}
+
+		rule = v1beta1.PrometheusPatchRuleNotActive(rule, v1beta1.InactiveReason, msg)
+
+		var remaining time.Duration
+		rule, remaining, err = r.deactivate(ctx, rule, now)
+		if remaining > 0 {
+			requeueAfter = minDuration(requeueAfter, remaining)
+		}
+	case !active:
+		msg := fmt.Sprintf("query did not return matching samples since %s", rule.Status.ResolvingSince.Format(time.RFC3339))
+		reason := v1beta1.ActiveReason
+		if rule.Status.State == v1beta1.StatePending {
+			reason = v1beta1.PendingReason
+		}
+
+		rule = v1beta1.PrometheusPatchRuleActive(rule, reason, msg)
+	case rule.Status.State == v1beta1.StatePending:
+		msg := "found query samples"
+		rule = v1beta1.PrometheusPatchRuleActive(rule, v1beta1.PendingReason, msg)
+	default:
 		msg := "found query samples"
-		activeCondition := meta.FindStatusCondition(rule.Status.Conditions, v1beta1.ActiveCondition)
-		if activeCondition == nil {
-			activeCondition = &metav1.Condition{}
+		rule = v1beta1.PrometheusPatchRuleActive(rule, v1beta1.ActiveReason, msg)
+
+		// During the cooldown the targets keep the patch set currently in effect
+		changed := patchSetChanged(rule, samples)
+		if remaining := cooldownRemaining(rule, now); changed && remaining > 0 {
+			msg := fmt.Sprintf("patch set changes after the cooldown elapsed in %s", remaining.Round(time.Second))
+			rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.CooldownReason, msg)
+			requeueAfter = minDuration(requeueAfter, remaining)
+			break
 		}
 
-		// If we have waiting window (spec.for) add pending condition reason
-		if activeCondition.Reason != v1beta1.PendingReason && activeCondition.Reason != v1beta1.ActiveReason && rule.Spec.For.Duration != 0 {
-			rule = v1beta1.PrometheusPatchRuleActive(rule, v1beta1.PendingReason, msg)
-			// Await wait time and apply patch or if there is no wait time apply patch right away
-		} else if activeCondition.LastTransitionTime.Time.Add(rule.Spec.For.Duration).Before(time.Now()) || rule.Spec.For.Duration == 0 {
-			rule = v1beta1.PrometheusPatchRuleActive(rule, v1beta1.ActiveReason, msg)
-			rule, err = r.applyPatches(ctx, rule)
+		var targets *targetRecorder
+		rule, targets, err = r.applyPatches(ctx, rule, samples)
+		if changed && !r.dryRun(rule) && (err == nil || targets.changed > 0) {
+			rule.Status.LastChangeAt = &metav1.Time{Time: now}
+		}
+
+		if rule.Spec.Enforce {
+			if watchErr := r.watchTargets(rule); watchErr != nil {
+				logger.Error(watchErr, "failed to watch targets")
+			}
 		}
-	} else {
-		msg := "query did not return samples"
-		rule = v1beta1.PrometheusPatchRuleNotActive(rule, v1beta1.InactiveReason, msg)
 	}
 
-	logger.Info("requeue next reconcile", "interval", rule.Spec.Interval.Duration)
+	logger.Info("requeue next reconcile", "interval", requeueAfter)
 
 	return rule, ctrl.Result{
-		RequeueAfter: rule.Spec.Interval.Duration,
+		RequeueAfter: requeueAfter,
 	}, err
 }
 
-func (r *PrometheusPatchRuleReconciler) applyPatches(ctx context.Context, rule v1beta1.PrometheusPatchRule) (v1beta1.PrometheusPatchRule, error) {
-	if len(rule.Spec.JSON6902Patches) == 0 {
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// evaluateState advances the state machine of the rule the same way Prometheus handles alerting rules.
+// A rule becomes pending as soon as the expression returns samples and fires once it kept returning samples
+// for spec.for. As soon as the expression does not return samples anymore the rule is inactive again, unless
+// the rule is kept pending (spec.resolveAfter) or firing (spec.keepFiringFor).
+func evaluateState(rule v1beta1.PrometheusPatchRule, active bool, now time.Time) v1beta1.PrometheusPatchRule {
+	rule.Status.LastEvaluation = &metav1.Time{Time: now}
+
+	if !active {
+		if hold := resolveDuration(rule); hold > 0 && rule.Status.ActiveAt != nil {
+			if rule.Status.ResolvingSince == nil {
+				rule.Status.ResolvingSince = &metav1.Time{Time: now}
+			}
+
+			if now.Sub(rule.Status.ResolvingSince.Time) < hold {
+				return rule
+			}
+		}
+
+		return resetState(rule)
+	}
+
+	rule.Status.ResolvingSince = nil
+
+	if rule.Status.ActiveAt == nil {
+		rule.Status.State = v1beta1.StatePending
+		rule.Status.ActiveAt = &metav1.Time{Time: now}
+	}
+
+	if rule.Status.State != v1beta1.StateFiring && now.Sub(rule.Status.ActiveAt.Time) >= rule.Spec.For.Duration {
+		rule.Status.State = v1beta1.StateFiring
+		rule.Status.FiredAt = &metav1.Time{Time: now}
+	}
+
+	return rule
+}
+
+// resetState marks the rule as inactive
+func resetState(rule v1beta1.PrometheusPatchRule) v1beta1.PrometheusPatchRule {
+	rule.Status.State = v1beta1.StateInactive
+	rule.Status.ActiveAt = nil
+	rule.Status.FiredAt = nil
+	rule.Status.ResolvingSince = nil
+	return rule
+}
+
+// deactivate reverts the patches of an inactive rule unless the cooldown is still in effect.
+// The remaining cooldown is returned if the patches have not been reverted yet.
+func (r *PrometheusPatchRuleReconciler) deactivate(ctx context.Context, rule v1beta1.PrometheusPatchRule, now time.Time) (v1beta1.PrometheusPatchRule, time.Duration, error) {
+	if !rule.Spec.Revert || (len(rule.Status.Snapshots) == 0 && len(rule.Status.Applied) == 0) {
+		rule.Status.ActiveTier = ""
+		return rule, 0, nil
+	}
+
+	if remaining := cooldownRemaining(rule, now); remaining > 0 {
+		msg := fmt.Sprintf("patches are reverted after the cooldown elapsed in %s", remaining.Round(time.Second))
+		rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.CooldownReason, msg)
+		return rule, remaining, nil
+	}
+
+	// A dry run must not change the targets, the snapshots are kept until the patches are actually reverted
+	if r.dryRun(rule) {
+		msg := fmt.Sprintf("dry run, %d targets would be reverted", len(rule.Status.Snapshots)+len(rule.Status.Applied))
+		rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.DryRunReason, msg)
+		return rule, 0, nil
+	}
+
+	rule, err := r.revertPatches(ctx, rule)
+	rule.Status.ActiveTier = ""
+	if err == nil {
+		rule.Status.LastChangeAt = &metav1.Time{Time: now}
+	}
+
+	return rule, 0, err
+}
+
+// resolveDuration returns how long the rule keeps its current state after the expression stopped returning samples
+func resolveDuration(rule v1beta1.PrometheusPatchRule) time.Duration {
+	switch {
+	case rule.Status.State == v1beta1.StateFiring && rule.Spec.KeepFiringFor != nil:
+		return rule.Spec.KeepFiringFor.Duration
+	case rule.Status.State == v1beta1.StatePending && rule.Spec.ResolveAfter != nil:
+		return rule.Spec.ResolveAfter.Duration
+	default:
+		return 0
+	}
+}
+
+// applyPatches applies all patches of the rule and returns the recorder holding the result of each target
+func (r *PrometheusPatchRuleReconciler) applyPatches(ctx context.Context, rule v1beta1.PrometheusPatchRule, samples model.Vector) (result v1beta1.PrometheusPatchRule, targets *targetRecorder, err error) {
+	targets = newTargetRecorder(rule.Status.Targets, r.MaxStatusTargets)
+	if len(rule.Spec.JSON6902Patches) == 0 && len(rule.Spec.ApplyPatches) == 0 &&
+		len(rule.Spec.StrategicMergePatches) == 0 && len(rule.Spec.MergePatches) == 0 && len(rule.Spec.Tiers) == 0 {
 		msg := "no patches have been defined"
 		rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.NoPatchFoundReason, msg)
-		return rule, nil
+		return rule, targets, nil
 	}
 
-	for _, patch := range rule.Spec.JSON6902Patches {
-		b, err := json.Marshal(patch.Patch)
-		if err != nil {
-			rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.PatchApplyFailedReason, err.Error())
-			return rule, err
+	kubeClient, err := r.targetClient(ctx, rule)
+	if err != nil {
+		err = fmt.Errorf("failed to build target client: %w", err)
+		rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, targetClientFailedReason(err), err.Error())
+		return rule, targets, err
+	}
+
+	// The results are recorded on the returned rule, after the return value has been assigned
+	defer func() {
+		result.Status.Targets = targets.targets
+	}()
+
+	// By default templates are rendered using the first sample of the query result while
+	// in per sample mode all patches are rendered and applied for each sample
+	var renderSamples []*model.Sample
+	switch {
+	case len(samples) == 0:
+		renderSamples = []*model.Sample{nil}
+	case rule.Spec.TargetMode == v1beta1.TargetModePerSample:
+		renderSamples = samples
+	default:
+		renderSamples = samples[:1]
+	}
+
+	// The active tier reported in the status is selected by the first sample
+	rule.Status.ActiveTier = ""
+	if tier := selectTier(rule, renderSamples[0]); tier != nil {
+		rule.Status.ActiveTier = tier.Name
+	}
+
+	// In atomic mode the original state of each patched target is captured and restored
+	// in reverse order as soon as a patch fails. Atomic mode implies the FailFast failure policy.
+	atomic := rule.Spec.Atomic && !r.dryRun(rule)
+	var originals []*unstructured.Unstructured
+	snapshots := rule.Status.DeepCopy().Snapshots
+	applied := rule.Status.DeepCopy().Applied
+
+	// With the Continue failure policy errors are collected and the remaining patches are still applied
+	continueOnError := !atomic && rule.Spec.FailurePolicy == v1beta1.FailurePolicyContinue
+	var errs []error
+
+	fail := func(reason string, err error) (v1beta1.PrometheusPatchRule, *targetRecorder, error) {
+		if !atomic || len(originals) == 0 {
+			rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, reason, err.Error())
+			return rule, targets, err
 		}
 
-		if patch.Target.Name == "" {
-			res := unstructured.UnstructuredList{}
-			res.SetGroupVersionKind(schema.GroupVersionKind{
-				Group:   patch.Target.Group,
-				Version: patch.Target.Version,
-				Kind:    patch.Target.Kind,
-			})
+		rule.Status.Snapshots = snapshots
+		rule.Status.Applied = applied
 
-			set, err := labels.ConvertSelectorToLabelsMap(patch.Target.LabelSelector)
-			if err != nil {
-				return rule, err
+		if rollbackErr := r.rollback(ctx, kubeClient, originals); rollbackErr != nil {
+			err = fmt.Errorf("%w, rollback failed: %s", err, rollbackErr.Error())
+			rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.RollbackFailedReason, err.Error())
+			return rule, targets, err
+		}
+
+		targets.rolledBack()
+		msg := fmt.Sprintf("patched targets have been rolled back: %s", err.Error())
+		rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.RolledBackReason, msg)
+		return rule, targets, err
+	}
+
+	var rendered int
+	for _, sample := range renderSamples {
+		data := newTemplateData(rule, sample)
+		entries, err := renderPatchEntries(rule, data)
+		if err == nil {
+			var tierEntries []patchEntry
+			tierEntries, err = renderTierPatchEntries(selectTier(rule, sample), data)
+			entries = append(entries, tierEntries...)
+		}
+
+		if err != nil {
+			if !continueOnError {
+				return fail(v1beta1.PatchApplyFailedReason, err)
 			}
 
-			err = r.Client.List(ctx, &res, client.MatchingLabels(set))
+			errs = append(errs, err)
+			continue
+		}
 
+		rendered += len(entries)
+		for _, entry := range entries {
+			items, err := r.findTargets(ctx, kubeClient, entry.target)
 			if err != nil {
-				err = fmt.Errorf("failed to find target resources: %w", err)
-				rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.PatchApplyFailedReason, err.Error())
-				return rule, err
+				targets.record(entry, selectorReference(entry.target), err)
+				if !continueOnError {
+					return fail(findTargetsFailedReason(err), err)
+				}
+
+				errs = append(errs, err)
+				continue
 			}
 
-			for _, item := range res.Items {
-				if err := r.Client.Patch(ctx, &item, client.RawPatch(types.JSONPatchType, b), client.FieldOwner(r.FieldManager)); err != nil {
-					return rule, err
+			for i := range items {
+				original := items[i].DeepCopy()
+				rule, err = r.patchTarget(ctx, kubeClient, rule, targets, entry, &items[i])
+				if err != nil {
+					err = fmt.Errorf("failed to apply patch to %s %s: %w", items[i].GetKind(), objectKey(&items[i]), err)
+					if !continueOnError {
+						return fail(v1beta1.PatchApplyFailedReason, err)
+					}
+
+					errs = append(errs, err)
+					continue
 				}
 
-				if err != nil {
-					break
+				if atomic {
+					originals = append(originals, original)
 				}
 			}
+		}
+	}
 
-			if err != nil {
-				err = fmt.Errorf("failed to apply patch: %w", err)
-				rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.PatchApplyFailedReason, err.Error())
-				return rule, err
-			}
-		} else {
-			res := unstructured.Unstructured{}
-			res.SetGroupVersionKind(schema.GroupVersionKind{
-				Group:   patch.Target.Group,
-				Version: patch.Target.Version,
-				Kind:    patch.Target.Kind,
-			})
-
-			err = r.Client.Get(ctx, client.ObjectKey{
-				Name:      patch.Target.Name,
-				Namespace: patch.Target.Namespace,
-			}, &res)
+	if len(errs) > 0 {
+		err := utilerrors.NewAggregate(errs)
+		reason := v1beta1.PatchApplyFailedReason
+		if targets.succeeded > 0 {
+			reason = v1beta1.PartiallyAppliedReason
+		}
 
+		rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, reason, err.Error())
+		return rule, targets, err
+	}
+
+	if rendered == 0 {
+		msg := "no tier matches the query samples"
+		rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.NoPatchFoundReason, msg)
+		return rule, targets, nil
+	}
+
+	if r.dryRun(rule) {
+		msg := fmt.Sprintf("dry run, %d targets would be patched", targets.dryRuns)
+		rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.DryRunReason, msg)
+		return rule, targets, nil
+	}
+
+	rule = v1beta1.PrometheusPatchRulePatchApplied(rule, v1beta1.PatchAppliedReason)
+	return rule, targets, nil
+}
+
+// patchTarget sends the patch for the given target and records the result. In dry run mode the patch is only
+// evaluated by the api server and the resulting diff gets recorded.
+func (r *PrometheusPatchRuleReconciler) patchTarget(ctx context.Context, kubeClient client.Client, rule v1beta1.PrometheusPatchRule, targets *targetRecorder, entry patchEntry, item *unstructured.Unstructured) (v1beta1.PrometheusPatchRule, error) {
+	var err error
+	ref := resourceReference(item)
+	dryRun := r.dryRun(rule)
+
+	// Skip the api request if the patch does not change the target
+	if patched, ok := entry.apply(item); ok {
+		if diff, err := mergePatchDiff(item, patched); err == nil && string(diff) == "{}" {
+			targets.unchanged(entry, ref, item.GetResourceVersion())
+			return rule, nil
+		}
+	}
+
+	if rule.Spec.Revert && !dryRun {
+		if entry.manifest != nil {
+			rule.Status.Applied = addResourceReference(rule.Status.Applied, ref)
+		} else {
+			rule.Status.Snapshots, err = takeSnapshot(rule.Status.Snapshots, item, entry.ops)
 			if err != nil {
-				err = fmt.Errorf("failed to apply patch: %w", err)
-				rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.PatchApplyFailedReason, err.Error())
+				err = fmt.Errorf("failed to snapshot target: %w", err)
+				targets.record(entry, ref, err)
 				return rule, err
 			}
+		}
+	}
 
-			if err := r.Client.Patch(ctx, &res, client.RawPatch(types.JSONPatchType, b), client.FieldOwner(r.FieldManager)); err != nil {
-				return rule, err
-			}
+	current := item.DeepCopy()
+	obj := entry.object(item)
+	opts := []client.PatchOption{client.FieldOwner(r.FieldManager)}
+	if dryRun {
+		opts = append(opts, client.DryRunAll)
+	}
+
+	if err := kubeClient.Patch(ctx, obj, entry.patch, opts...); err != nil {
+		targets.record(entry, ref, err)
+		return rule, err
+	}
+
+	if !dryRun {
+		targets.applied(entry, ref, obj.GetResourceVersion())
+		return rule, nil
+	}
+
+	b, err := mergePatchDiff(current, obj)
+	if err != nil {
+		targets.record(entry, ref, err)
+		return rule, err
+	}
+
+	diff := string(b)
+	targets.dryRun(entry, ref, diff)
+	r.Recorder.Eventf(&rule, "Normal", v1beta1.DryRunReason, "dry run patch %s %s/%s: %s", ref.Kind, ref.Namespace, ref.Name, diff)
+	return rule, nil
+}
+
+func (r *PrometheusPatchRuleReconciler) dryRun(rule v1beta1.PrometheusPatchRule) bool {
+	return r.DryRun || rule.Spec.DryRun
+}
+
+// targetClient returns the client used to find and patch the targets of the rule.
+// If the rule references a kubeconfig a client for the remote cluster is built from it.
+// If the rule (or the controller by default) specifies a service account the client impersonates it.
+func (r *PrometheusPatchRuleReconciler) targetClient(ctx context.Context, rule v1beta1.PrometheusPatchRule) (client.Client, error) {
+	name := r.DefaultServiceAccount
+	if rule.Spec.ServiceAccountName != "" {
+		name = rule.Spec.ServiceAccountName
+	}
+
+	impersonator := fluxclient.NewImpersonator(r.Client, nil, polling.Options{}, rule.Spec.KubeConfig, r.KubeConfigOpts, r.DefaultServiceAccount, rule.Spec.ServiceAccountName, rule.Namespace)
+	if !impersonator.CanImpersonate(ctx) {
+		return nil, fmt.Errorf("%w: %s/%s", errServiceAccountMissing, rule.Namespace, name)
+	}
+
+	// The identity of a client changes with the impersonated service account or an updated kubeconfig
+	var identity string
+	switch {
+	case rule.Spec.KubeConfig != nil:
+		secret := &corev1.Secret{}
+		if err := r.Client.Get(ctx, client.ObjectKey{Name: rule.Spec.KubeConfig.SecretRef.Name, Namespace: rule.Namespace}, secret); err != nil {
+			return nil, fmt.Errorf("unable to read kubeconfig secret: %w", err)
 		}
 
+		identity = fmt.Sprintf("kubeconfig/%s/%s/%s/%s", secret.Name, rule.Spec.KubeConfig.SecretRef.Key, secret.ResourceVersion, name)
+	case name != "":
+		identity = fmt.Sprintf("serviceaccount/%s", name)
+	default:
+		return r.Client, nil
 	}
 
-	rule = v1beta1.PrometheusPatchRulePatchApplied(rule, v1beta1.PatchAppliedReason)
+	key := objectKey(&rule).String()
+	if kubeClient, ok := r.targetClients.get(key, identity); ok {
+		return kubeClient, nil
+	}
+
+	var kubeClient client.Client
+	var err error
+	if rule.Spec.KubeConfig == nil && r.restConfig != nil {
+		kubeClient, err = impersonatingClient(r.restConfig, client.Options{Scheme: r.Client.Scheme()}, rule.Namespace, name)
+	} else {
+		kubeClient, _, err = impersonator.GetClient(ctx)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.targetClients.set(key, identity, kubeClient)
+	return kubeClient, nil
+}
+
+// targetClientFailedReason returns the condition reason for an error returned by targetClient
+func targetClientFailedReason(err error) string {
+	if errors.Is(err, errServiceAccountMissing) {
+		return v1beta1.ServiceAccountNotFoundReason
+	}
+
+	return v1beta1.InvalidKubeConfigReason
+}
+
+// findTargets returns all resources matching the target selector
+func (r *PrometheusPatchRuleReconciler) findTargets(ctx context.Context, kubeClient client.Client, target v1beta1.Selector) ([]unstructured.Unstructured, error) {
+	gvk, err := r.resolveGVK(kubeClient, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve target: %w", err)
+	}
+
+	if target.Name != "" {
+		res := unstructured.Unstructured{}
+		res.SetGroupVersionKind(gvk)
+
+		err := kubeClient.Get(ctx, client.ObjectKey{
+			Name:      target.Name,
+			Namespace: target.Namespace,
+		}, &res)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to find target resource: %w", err)
+		}
+
+		return []unstructured.Unstructured{res}, nil
+	}
+
+	selector, err := labels.Parse(target.LabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector: %w", err)
+	}
+
+	namespaces, err := r.targetNamespaces(ctx, kubeClient, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find target namespaces: %w", err)
+	}
+
+	var items []unstructured.Unstructured
+	for _, namespace := range namespaces {
+		list := unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk)
+
+		err = kubeClient.List(ctx, &list, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector})
+		if err != nil {
+			return nil, fmt.Errorf("failed to find target resources: %w", err)
+		}
+
+		items = append(items, list.Items...)
+	}
+
+	return items, nil
+}
+
+// resolveGVK resolves the group version kind of the target using discovery.
+// The target is either selected by kind or by resource name, if no version is given the preferred version
+// of the api server is used.
+func (r *PrometheusPatchRuleReconciler) resolveGVK(kubeClient client.Client, target v1beta1.Selector) (schema.GroupVersionKind, error) {
+	mapper := kubeClient.RESTMapper()
+
+	switch {
+	case target.Kind != "":
+		var versions []string
+		if target.Version != "" {
+			versions = append(versions, target.Version)
+		}
+
+		mapping, err := mapper.RESTMapping(schema.GroupKind{
+			Group: target.Group,
+			Kind:  target.Kind,
+		}, versions...)
+		if err != nil {
+			return schema.GroupVersionKind{}, err
+		}
+
+		return mapping.GroupVersionKind, nil
+	case target.Resource != "":
+		return mapper.KindFor(schema.GroupVersionResource{
+			Group:    target.Group,
+			Version:  target.Version,
+			Resource: target.Resource,
+		})
+	default:
+		return schema.GroupVersionKind{}, errMissingTargetKind
+	}
+}
+
+// findTargetsFailedReason returns the condition reason for an error returned by findTargets
+func findTargetsFailedReason(err error) string {
+	if meta.IsNoMatchError(err) || errors.Is(err, errMissingTargetKind) {
+		return v1beta1.UnknownTargetReason
+	}
+
+	return v1beta1.PatchApplyFailedReason
+}
+
+// targetNamespaces returns the namespaces resources are listed from.
+// An empty namespace means all namespaces (or a cluster scoped resource).
+func (r *PrometheusPatchRuleReconciler) targetNamespaces(ctx context.Context, kubeClient client.Client, target v1beta1.Selector) ([]string, error) {
+	if target.NamespaceSelector == "" {
+		return []string{target.Namespace}, nil
+	}
+
+	selector, err := labels.Parse(target.NamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace selector: %w", err)
+	}
+
+	list := corev1.NamespaceList{}
+	if err := kubeClient.List(ctx, &list, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+
+	var namespaces []string
+	for _, namespace := range list.Items {
+		if target.Namespace == "" || target.Namespace == namespace.Name {
+			namespaces = append(namespaces, namespace.Name)
+		}
+	}
+
+	return namespaces, nil
+}
+
+func (r *PrometheusPatchRuleReconciler) revertPatches(ctx context.Context, rule v1beta1.PrometheusPatchRule) (v1beta1.PrometheusPatchRule, error) {
+	kubeClient, err := r.targetClient(ctx, rule)
+	if err != nil {
+		err = fmt.Errorf("failed to build target client: %w", err)
+		rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, targetClientFailedReason(err), err.Error())
+		return rule, err
+	}
+
+	for i, snapshot := range rule.Status.Snapshots {
+		if err := r.revertSnapshot(ctx, kubeClient, snapshot); err != nil {
+			// Keep the snapshots which have not been restored yet
+			rule.Status.Snapshots = rule.Status.Snapshots[i:]
+			err = fmt.Errorf("failed to revert patch: %w", err)
+			rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.PatchRevertFailedReason, err.Error())
+			return rule, err
+		}
+	}
+
+	rule.Status.Snapshots = nil
+
+	for i, ref := range rule.Status.Applied {
+		if err := r.unapply(ctx, kubeClient, ref); err != nil {
+			rule.Status.Applied = rule.Status.Applied[i:]
+			err = fmt.Errorf("failed to unapply patch: %w", err)
+			rule = v1beta1.PrometheusPatchRuleNoPatchApplied(rule, v1beta1.PatchRevertFailedReason, err.Error())
+			return rule, err
+		}
+	}
+
+	rule.Status.Applied = nil
+	rule = v1beta1.PrometheusPatchRulePatchReverted(rule, "patches have been reverted")
 	return rule, nil
 }
 
+func (r *PrometheusPatchRuleReconciler) revertSnapshot(ctx context.Context, kubeClient client.Client, snapshot v1beta1.ObjectSnapshot) error {
+	res := unstructured.Unstructured{}
+	res.SetAPIVersion(snapshot.APIVersion)
+	res.SetKind(snapshot.Kind)
+
+	err := kubeClient.Get(ctx, client.ObjectKey{
+		Name:      snapshot.Name,
+		Namespace: snapshot.Namespace,
+	}, &res)
+
+	// There is nothing to restore if the object is gone
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ops, err := revertOperations(&res, snapshot)
+	if err != nil {
+		return err
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+
+	return kubeClient.Patch(ctx, &res, client.RawPatch(types.JSONPatchType, b), client.FieldOwner(r.FieldManager))
+}
+
+// rollback restores the captured original state of the given objects in reverse order
+func (r *PrometheusPatchRuleReconciler) rollback(ctx context.Context, kubeClient client.Client, originals []*unstructured.Unstructured) error {
+	for i := len(originals) - 1; i >= 0; i-- {
+		original := originals[i]
+		res := unstructured.Unstructured{}
+		res.SetGroupVersionKind(original.GroupVersionKind())
+
+		err := kubeClient.Get(ctx, client.ObjectKeyFromObject(original), &res)
+		if kerrors.IsNotFound(err) {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		patch, err := mergePatchDiff(&res, original)
+		if err != nil {
+			return err
+		}
+
+		if string(patch) == "{}" {
+			continue
+		}
+
+		if err := kubeClient.Patch(ctx, &res, client.RawPatch(types.MergePatchType, patch), client.FieldOwner(r.FieldManager)); err != nil {
+			return fmt.Errorf("failed to roll back %s %s: %w", original.GetKind(), objectKey(original), err)
+		}
+	}
+
+	return nil
+}
+
+// unapply drops all fields owned by the field manager by applying an empty manifest
+func (r *PrometheusPatchRuleReconciler) unapply(ctx context.Context, kubeClient client.Client, ref v1beta1.ResourceReference) error {
+	res := unstructured.Unstructured{}
+	res.SetAPIVersion(ref.APIVersion)
+	res.SetKind(ref.Kind)
+
+	err := kubeClient.Get(ctx, client.ObjectKey{
+		Name:      ref.Name,
+		Namespace: ref.Namespace,
+	}, &res)
+
+	// An apply would recreate the object, there is nothing to unapply if it is gone
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	obj := unstructured.Unstructured{}
+	obj.SetAPIVersion(ref.APIVersion)
+	obj.SetKind(ref.Kind)
+	obj.SetName(ref.Name)
+	obj.SetNamespace(ref.Namespace)
+
+	return kubeClient.Patch(ctx, &obj, client.Apply, client.FieldOwner(r.FieldManager))
+}
+
 func (r *PrometheusPatchRuleReconciler) parseValue(value model.Value) (model.Vector, error) {
 	switch value.Type() {
 	case model.ValVector:
@@ -19,14 +19,19 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
+	"github.com/fluxcd/pkg/apis/meta"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/common/model"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 	corev1 "k8s.io/api/core/v1"
 	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
@@ -299,6 +304,73 @@ var _ = Describe("PrometheusPatchRule tests", func() {
 		})
 	})
 
+	Describe("rule is active if expression returns samples from a referenced PrometheusSource", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keySource   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates PrometheusSource successfully", func() {
+			keySource = types.NamespacedName{
+				Name:      "source-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &v1beta1.PrometheusSource{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keySource.Name,
+					Namespace: keySource.Namespace,
+				},
+				Spec: v1beta1.PrometheusSourceSpec{
+					PrometheusSpec: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					PrometheusRef: &v1beta1.PrometheusReference{
+						Kind: v1beta1.PrometheusSourceKind,
+						Name: keySource.Name,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("Active condition is True with reason Active", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+
+				return len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[0].Reason == v1beta1.ActiveReason &&
+					got.Status.Conditions[0].Status == "True" &&
+					got.Status.Conditions[0].Type == v1beta1.ActiveCondition
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
 	Describe("patch is applied to single resource selector", func() {
 		var (
 			createdRule *v1beta1.PrometheusPatchRule
@@ -634,7 +706,10 @@ var _ = Describe("PrometheusPatchRule tests", func() {
 				return len(got.Status.Conditions) == 1 &&
 					got.Status.Conditions[0].Reason == v1beta1.PendingReason &&
 					got.Status.Conditions[0].Status == "True" &&
-					got.Status.Conditions[0].Type == v1beta1.ActiveCondition
+					got.Status.Conditions[0].Type == v1beta1.ActiveCondition &&
+					got.Status.State == v1beta1.StatePending &&
+					got.Status.ActiveAt != nil &&
+					got.Status.FiredAt == nil
 			}, timeout, interval).Should(BeTrue())
 		})
 
@@ -646,8 +721,2286 @@ var _ = Describe("PrometheusPatchRule tests", func() {
 				return len(got.Status.Conditions) == 2 &&
 					got.Status.Conditions[0].Reason == v1beta1.ActiveReason &&
 					got.Status.Conditions[0].Status == "True" &&
-					got.Status.Conditions[0].Type == v1beta1.ActiveCondition
+					got.Status.Conditions[0].Type == v1beta1.ActiveCondition &&
+					got.Status.State == v1beta1.StateFiring &&
+					got.Status.FiredAt != nil &&
+					got.Status.FiredAt.Sub(got.Status.ActiveAt.Time) >= duration
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("pending state is restarted if the spec changes", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			activeAt    metav1.Time
+		)
+
+		evaluationInterval, err := time.ParseDuration("1s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		duration, err := time.ParseDuration("1h")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse for duration")
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: evaluationInterval,
+					},
+					For: metav1.Duration{
+						Duration: duration,
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("is pending", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return got.Status.State == v1beta1.StatePending && got.Status.ActiveAt != nil
+			}, timeout, interval).Should(BeTrue())
+
+			activeAt = *got.Status.ActiveAt
+		})
+
+		It("restarts pending after the expression has been changed", func() {
+			// metav1.Time is serialized with second precision
+			time.Sleep(time.Second)
+
+			got := &v1beta1.PrometheusPatchRule{}
+			Expect(k8sClient.Get(context.Background(), keyRule, got)).Should(Succeed())
+			got.Spec.Expr = "prometheus_build_info >= 1"
+			Expect(k8sClient.Update(context.Background(), got)).Should(Succeed())
+
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return got.Status.ObservedGeneration == got.Generation &&
+					got.Status.State == v1beta1.StatePending &&
+					got.Status.ActiveAt != nil &&
+					got.Status.ActiveAt.After(activeAt.Time)
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("patches are reverted once the expression does not return samples anymore", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr:   "prometheus_build_info > 0",
+					Revert: true,
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					JSON6902Patches: []v1beta1.JSON6902Patch{
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: []v1beta1.JSONPatch{
+								v1beta1.JSONPatch{
+									OP:   "add",
+									Path: "/metadata/annotations",
+									Value: extv1.JSON{
+										Raw: []byte(`{"foo":"bar"}`),
+									},
+								},
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("records a snapshot and patches the target", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Snapshots) == 1 &&
+					got.Status.Snapshots[0].Name == keyTarget.Name &&
+					len(got.Status.Snapshots[0].Paths) == 1 &&
+					got.Status.Snapshots[0].Paths[0].Path == "/metadata/annotations" &&
+					got.Status.Snapshots[0].Paths[0].Value == nil
+			}, timeout, interval).Should(BeTrue())
+
+			target := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTarget, target)
+				return target.Annotations["foo"] == "bar"
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("reverts the patch once the rule is inactive", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Expect(k8sClient.Get(context.Background(), keyRule, got)).Should(Succeed())
+			got.Spec.Expr = "non_existing_metric > 0"
+			Expect(k8sClient.Update(context.Background(), got)).Should(Succeed())
+
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Conditions) == 2 &&
+					len(got.Status.Snapshots) == 0 &&
+					got.Status.Conditions[1].Reason == v1beta1.PatchRevertedReason &&
+					got.Status.Conditions[1].Status == "False" &&
+					got.Status.Conditions[1].Type == v1beta1.PatchAppliedCondition
+			}, timeout, interval).Should(BeTrue())
+
+			target := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTarget, target)
+				_, ok := target.Annotations["foo"]
+				return !ok
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("patch values are rendered from templates", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "vector(3)",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					JSON6902Patches: []v1beta1.JSON6902Patch{
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: []v1beta1.JSONPatch{
+								v1beta1.JSONPatch{
+									OP:            "add",
+									Path:          "/metadata/annotations",
+									ValueTemplate: `{"rule": {{ .Rule.Name | quote }}, "value": {{ .Value | int | quote }}}`,
+								},
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("actually has resource patched with the rendered value", func() {
+			target := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTarget, target)
+				return target.Annotations["rule"] == keyRule.Name &&
+					target.Annotations["value"] == "3"
 			}, timeout, interval).Should(BeTrue())
 		})
 	})
+
+	Describe("patches are applied to targets derived from each sample", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTargets  []types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMaps successfully", func() {
+			for i := 0; i < 2; i++ {
+				key := types.NamespacedName{
+					Name:      "target-" + randStringRunes(5),
+					Namespace: "default",
+				}
+
+				Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      key.Name,
+						Namespace: key.Namespace,
+					},
+				})).Should(Succeed())
+
+				keyTargets = append(keyTargets, key)
+			}
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: fmt.Sprintf(`label_replace(vector(1), "name", "%s", "", "") or label_replace(vector(2), "name", "%s", "", "")`,
+						keyTargets[0].Name, keyTargets[1].Name),
+					TargetMode: v1beta1.TargetModePerSample,
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					JSON6902Patches: []v1beta1.JSON6902Patch{
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      "{{ .Labels.name }}",
+								Namespace: "default",
+							},
+							Patch: []v1beta1.JSONPatch{
+								v1beta1.JSONPatch{
+									OP:            "add",
+									Path:          "/metadata/annotations",
+									ValueTemplate: `{"value": {{ .Value | int | quote }}}`,
+								},
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("actually has each target patched with its own sample", func() {
+			for i, key := range keyTargets {
+				target := &corev1.ConfigMap{}
+				expected := fmt.Sprint(i + 1)
+				Eventually(func() bool {
+					_ = k8sClient.Get(context.Background(), key, target)
+					return target.Annotations["value"] == expected
+				}, timeout, interval).Should(BeTrue())
+			}
+		})
+	})
+
+	Describe("patches selected by labels are only applied within the target namespace", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTargets  []types.NamespacedName
+			app         string
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMaps in two namespaces successfully", func() {
+			app = randStringRunes(5)
+
+			for i := 0; i < 2; i++ {
+				key := types.NamespacedName{
+					Name:      "target-" + randStringRunes(5),
+					Namespace: "ns-" + randStringRunes(5),
+				}
+
+				Expect(k8sClient.Create(context.Background(), &corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: key.Namespace,
+					},
+				})).Should(Succeed())
+
+				Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      key.Name,
+						Namespace: key.Namespace,
+						Labels: map[string]string{
+							"app": app,
+						},
+					},
+				})).Should(Succeed())
+
+				keyTargets = append(keyTargets, key)
+			}
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					JSON6902Patches: []v1beta1.JSON6902Patch{
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Version:       "v1",
+								Kind:          "ConfigMap",
+								Namespace:     keyTargets[0].Namespace,
+								LabelSelector: "app=" + app,
+							},
+							Patch: []v1beta1.JSONPatch{
+								v1beta1.JSONPatch{
+									OP:   "add",
+									Path: "/metadata/annotations",
+									Value: extv1.JSON{
+										Raw: []byte(`{"foo":"bar"}`),
+									},
+								},
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("PatchesApplied condition is True", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+
+				return len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[1].Reason == v1beta1.PatchAppliedReason &&
+					got.Status.Conditions[1].Status == "True" &&
+					got.Status.Conditions[1].Type == v1beta1.PatchAppliedCondition
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("patches the resource in the target namespace", func() {
+			got := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTargets[0], got)
+				return got.Annotations["foo"] == "bar"
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("leaves the resource in other namespaces untouched", func() {
+			got := &corev1.ConfigMap{}
+			Consistently(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTargets[1], got)
+				_, ok := got.Annotations["foo"]
+				return ok
+			}, duration, interval).Should(BeFalse())
+		})
+	})
+
+	Describe("apply patches are applied using server side apply and unapplied once inactive", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+				Data: map[string]string{
+					"existing": "value",
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr:   "prometheus_build_info > 0",
+					Revert: true,
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					ApplyPatches: []v1beta1.ApplyPatch{
+						{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: extv1.JSON{
+								Raw: []byte(`{"data":{"foo":"bar"}}`),
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("actually has resource applied with the field manager", func() {
+			got := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTarget, got)
+				if got.Data["foo"] != "bar" || got.Data["existing"] != "value" {
+					return false
+				}
+
+				for _, v := range got.ManagedFields {
+					if v.Manager == "test-suite" && v.Operation == metav1.ManagedFieldsOperationApply {
+						return true
+					}
+				}
+
+				return false
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("unapplies the patch once the rule is inactive", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Expect(k8sClient.Get(context.Background(), keyRule, got)).Should(Succeed())
+			got.Spec.Expr = "non_existing_metric > 0"
+			Expect(k8sClient.Update(context.Background(), got)).Should(Succeed())
+
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Applied) == 0 &&
+					len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[1].Reason == v1beta1.PatchRevertedReason
+			}, timeout, interval).Should(BeTrue())
+
+			target := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTarget, target)
+				_, ok := target.Data["foo"]
+				return !ok && target.Data["existing"] == "value"
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("strategic merge and merge patches are applied", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			target := v1beta1.Selector{
+				Version:   "v1",
+				Kind:      "ConfigMap",
+				Name:      keyTarget.Name,
+				Namespace: keyTarget.Namespace,
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					StrategicMergePatches: []v1beta1.MergePatch{
+						{
+							Target: target,
+							Patch: extv1.JSON{
+								Raw: []byte(`{"metadata":{"labels":{"foo":"bar"}}}`),
+							},
+						},
+					},
+					MergePatches: []v1beta1.MergePatch{
+						{
+							Target: target,
+							Patch: extv1.JSON{
+								Raw: []byte(`{"metadata":{"annotations":{"foo":"bar"}}}`),
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("actually has resource patched", func() {
+			got := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTarget, got)
+				return got.Labels["foo"] == "bar" && got.Annotations["foo"] == "bar"
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("patches are not persisted in dry run mode", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr:   "prometheus_build_info > 0",
+					DryRun: true,
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					JSON6902Patches: []v1beta1.JSON6902Patch{
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: []v1beta1.JSONPatch{
+								v1beta1.JSONPatch{
+									OP:   "add",
+									Path: "/metadata/annotations",
+									Value: extv1.JSON{
+										Raw: []byte(`{"foo":"bar"}`),
+									},
+								},
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("records the diff in the status", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[1].Reason == v1beta1.DryRunReason &&
+					len(got.Status.Targets) == 1 &&
+					got.Status.Targets[0].Name == keyTarget.Name &&
+					got.Status.Targets[0].Result == v1beta1.TargetResultDryRun &&
+					got.Status.Targets[0].Diff == `{"metadata":{"annotations":{"foo":"bar"}}}`
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("does not persist the patch", func() {
+			got := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(context.Background(), keyTarget, got)).Should(Succeed())
+			Expect(got.Annotations).NotTo(HaveKey("foo"))
+		})
+	})
+
+	Describe("patch is applied to a target selected by resource without version", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					JSON6902Patches: []v1beta1.JSON6902Patch{
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Resource:  "configmaps",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: []v1beta1.JSONPatch{
+								v1beta1.JSONPatch{
+									OP:   "add",
+									Path: "/metadata/annotations",
+									Value: extv1.JSON{
+										Raw: []byte(`{"foo":"bar"}`),
+									},
+								},
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("actually has resource patched", func() {
+			got := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTarget, got)
+				return got.Annotations["foo"] == "bar"
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("PatchApplied condition is False with reason UnknownTarget if the target kind does not exist", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					JSON6902Patches: []v1beta1.JSON6902Patch{
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Group:    "example.com",
+								Resource: "does-not-exist",
+								Name:     "foo",
+							},
+							Patch: []v1beta1.JSONPatch{
+								v1beta1.JSONPatch{
+									OP:   "add",
+									Path: "/metadata/annotations",
+									Value: extv1.JSON{
+										Raw: []byte(`{"foo":"bar"}`),
+									},
+								},
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("PatchesApplied condition is False", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[1].Reason == v1beta1.UnknownTargetReason &&
+					got.Status.Conditions[1].Status == "False" &&
+					got.Status.Conditions[1].Type == v1beta1.PatchAppliedCondition
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("patch results are recorded for each target", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			patch := []v1beta1.JSONPatch{
+				v1beta1.JSONPatch{
+					OP:   "add",
+					Path: "/metadata/annotations",
+					Value: extv1.JSON{
+						Raw: []byte(`{"foo":"bar"}`),
+					},
+				},
+			}
+
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					JSON6902Patches: []v1beta1.JSON6902Patch{
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: patch,
+						},
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      "does-not-exist",
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: patch,
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("records the applied and the failed target", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				if len(got.Status.Targets) != 2 {
+					return false
+				}
+
+				applied, failed := got.Status.Targets[0], got.Status.Targets[1]
+				return applied.Name == keyTarget.Name &&
+					applied.PatchType == v1beta1.PatchTypeJSON6902 &&
+					applied.PatchIndex == 0 &&
+					(applied.Result == v1beta1.TargetResultApplied || applied.Result == v1beta1.TargetResultUnchanged) &&
+					applied.LastAppliedTime != nil &&
+					applied.ResourceVersion != "" &&
+					failed.Name == "does-not-exist" &&
+					failed.PatchIndex == 1 &&
+					failed.Result == v1beta1.TargetResultFailed &&
+					failed.Error != ""
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("remaining patches are applied with failure policy Continue", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			patch := []v1beta1.JSONPatch{
+				v1beta1.JSONPatch{
+					OP:   "add",
+					Path: "/metadata/annotations",
+					Value: extv1.JSON{
+						Raw: []byte(`{"foo":"bar"}`),
+					},
+				},
+			}
+
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr:          "prometheus_build_info > 0",
+					FailurePolicy: v1beta1.FailurePolicyContinue,
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					JSON6902Patches: []v1beta1.JSON6902Patch{
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      "does-not-exist",
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: patch,
+						},
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: patch,
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("PatchesApplied condition is False with reason PartiallyApplied", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[1].Reason == v1beta1.PartiallyAppliedReason &&
+					got.Status.Conditions[1].Status == "False" &&
+					got.Status.Conditions[1].Type == v1beta1.PatchAppliedCondition
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("actually has the second target patched", func() {
+			got := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTarget, got)
+				return got.Annotations["foo"] == "bar"
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("patched targets are rolled back in atomic mode if a patch fails", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+				Data: map[string]string{
+					"foo": "original",
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr:   "prometheus_build_info > 0",
+					Atomic: true,
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					MergePatches: []v1beta1.MergePatch{
+						{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: extv1.JSON{
+								Raw: []byte(`{"data":{"foo":"patched","bar":"added"}}`),
+							},
+						},
+						{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      "does-not-exist",
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: extv1.JSON{
+								Raw: []byte(`{"data":{"foo":"patched"}}`),
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("PatchesApplied condition is False with reason RolledBack", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[1].Reason == v1beta1.RolledBackReason &&
+					got.Status.Conditions[1].Status == "False" &&
+					got.Status.Conditions[1].Type == v1beta1.PatchAppliedCondition &&
+					len(got.Status.Targets) == 2 &&
+					got.Status.Targets[0].Result == v1beta1.TargetResultRolledBack
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("has the original state of the target restored", func() {
+			got := &corev1.ConfigMap{}
+			Eventually(func() map[string]string {
+				_ = k8sClient.Get(context.Background(), keyTarget, got)
+				return got.Data
+			}, timeout, interval).Should(Equal(map[string]string{
+				"foo": "original",
+			}))
+		})
+	})
+
+	Describe("patches which do not change the target are skipped", func() {
+		var (
+			createdRule     *v1beta1.PrometheusPatchRule
+			keyRule         types.NamespacedName
+			keyTarget       types.NamespacedName
+			resourceVersion string
+		)
+
+		duration, err := time.ParseDuration("1s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					JSON6902Patches: []v1beta1.JSON6902Patch{
+						v1beta1.JSON6902Patch{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: []v1beta1.JSONPatch{
+								v1beta1.JSONPatch{
+									OP:   "add",
+									Path: "/metadata/annotations",
+									Value: extv1.JSON{
+										Raw: []byte(`{"foo":"bar"}`),
+									},
+								},
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("records the target as unchanged", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Targets) == 1 &&
+					got.Status.Targets[0].Result == v1beta1.TargetResultUnchanged &&
+					got.Status.Targets[0].LastAppliedTime != nil
+			}, timeout, interval).Should(BeTrue())
+
+			target := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(context.Background(), keyTarget, target)).Should(Succeed())
+			Expect(target.Annotations["foo"]).To(Equal("bar"))
+			resourceVersion = target.ResourceVersion
+		})
+
+		It("does not update the target anymore", func() {
+			target := &corev1.ConfigMap{}
+			Consistently(func() string {
+				_ = k8sClient.Get(context.Background(), keyTarget, target)
+				return target.ResourceVersion
+			}, 3*duration, interval).Should(Equal(resourceVersion))
+		})
+	})
+
+	Describe("patches are re-applied as soon as an enforced target changes", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("1h")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr:    "prometheus_build_info > 0",
+					Enforce: true,
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					MergePatches: []v1beta1.MergePatch{
+						{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: extv1.JSON{
+								Raw: []byte(`{"data":{"foo":"bar"}}`),
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("actually has resource patched", func() {
+			got := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTarget, got)
+				return got.Data["foo"] == "bar"
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("re-applies the patch after the target has been changed", func() {
+			got := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(context.Background(), keyTarget, got)).Should(Succeed())
+			got.Data["foo"] = "reverted"
+			Expect(k8sClient.Update(context.Background(), got)).Should(Succeed())
+
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTarget, got)
+				return got.Data["foo"] == "bar"
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("PatchApplied condition is False with reason InvalidKubeConfig if the kubeconfig secret does not exist", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					KubeConfig: &meta.KubeConfigReference{
+						SecretRef: meta.SecretKeyReference{
+							Name: "does-not-exist",
+						},
+					},
+					MergePatches: []v1beta1.MergePatch{
+						{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      "foo",
+								Namespace: "default",
+							},
+							Patch: extv1.JSON{
+								Raw: []byte(`{"data":{"foo":"bar"}}`),
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("PatchesApplied condition is False", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[1].Reason == v1beta1.InvalidKubeConfigReason &&
+					got.Status.Conditions[1].Status == "False" &&
+					got.Status.Conditions[1].Type == v1beta1.PatchAppliedCondition
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("PatchApplied condition is False with reason ServiceAccountNotFound if the service account does not exist", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					ServiceAccountName: "does-not-exist",
+					MergePatches: []v1beta1.MergePatch{
+						{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      "foo",
+								Namespace: "default",
+							},
+							Patch: extv1.JSON{
+								Raw: []byte(`{"data":{"foo":"bar"}}`),
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("PatchesApplied condition is False", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[1].Reason == v1beta1.ServiceAccountNotFoundReason &&
+					got.Status.Conditions[1].Status == "False" &&
+					got.Status.Conditions[1].Type == v1beta1.PatchAppliedCondition
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("PatchApplied condition is False if the service account is not allowed to patch the target", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap and ServiceAccount without permissions successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ServiceAccount{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "no-permissions-" + keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					ServiceAccountName: "no-permissions-" + keyTarget.Name,
+					MergePatches: []v1beta1.MergePatch{
+						{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: extv1.JSON{
+								Raw: []byte(`{"data":{"foo":"bar"}}`),
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("PatchesApplied condition is False with a forbidden error", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[1].Reason == v1beta1.PatchApplyFailedReason &&
+					got.Status.Conditions[1].Status == "False" &&
+					got.Status.Conditions[1].Type == v1beta1.PatchAppliedCondition &&
+					strings.Contains(got.Status.Conditions[1].Message, "forbidden")
+			}, timeout, interval).Should(BeTrue())
+
+			target := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(context.Background(), keyTarget, target)).Should(Succeed())
+			Expect(target.Data).NotTo(HaveKey("foo"))
+		})
+	})
+
+	Describe("rules are kept pending or firing while the expression is empty for less than the resolve window", func() {
+		start := time.Now()
+
+		newRule := func(state string) v1beta1.PrometheusPatchRule {
+			rule := v1beta1.PrometheusPatchRule{
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					For:           metav1.Duration{Duration: time.Minute},
+					KeepFiringFor: &metav1.Duration{Duration: 10 * time.Minute},
+					ResolveAfter:  &metav1.Duration{Duration: 2 * time.Minute},
+				},
+			}
+
+			rule.Status.State = state
+			rule.Status.ActiveAt = &metav1.Time{Time: start}
+			if state == v1beta1.StateFiring {
+				rule.Status.FiredAt = &metav1.Time{Time: start.Add(time.Minute)}
+			}
+
+			return rule
+		}
+
+		It("keeps a pending rule pending within resolveAfter", func() {
+			rule := evaluateState(newRule(v1beta1.StatePending), false, start.Add(30*time.Second))
+			Expect(rule.Status.State).To(Equal(v1beta1.StatePending))
+			Expect(rule.Status.ActiveAt.Time).To(Equal(start))
+			Expect(rule.Status.ResolvingSince.Time).To(Equal(start.Add(30 * time.Second)))
+		})
+
+		It("continues the pending window once samples are returned again", func() {
+			rule := evaluateState(newRule(v1beta1.StatePending), false, start.Add(30*time.Second))
+			rule = evaluateState(rule, true, start.Add(time.Minute))
+			Expect(rule.Status.State).To(Equal(v1beta1.StateFiring))
+			Expect(rule.Status.ResolvingSince).To(BeNil())
+		})
+
+		It("resolves a pending rule after resolveAfter", func() {
+			rule := evaluateState(newRule(v1beta1.StatePending), false, start.Add(30*time.Second))
+			rule = evaluateState(rule, false, start.Add(150*time.Second))
+			Expect(rule.Status.State).To(Equal(v1beta1.StateInactive))
+			Expect(rule.Status.ActiveAt).To(BeNil())
+			Expect(rule.Status.ResolvingSince).To(BeNil())
+		})
+
+		It("keeps a firing rule firing within keepFiringFor", func() {
+			rule := evaluateState(newRule(v1beta1.StateFiring), false, start.Add(2*time.Minute))
+			rule = evaluateState(rule, false, start.Add(11*time.Minute))
+			Expect(rule.Status.State).To(Equal(v1beta1.StateFiring))
+			Expect(rule.Status.FiredAt.Time).To(Equal(start.Add(time.Minute)))
+		})
+
+		It("resolves a firing rule after keepFiringFor", func() {
+			rule := evaluateState(newRule(v1beta1.StateFiring), false, start.Add(2*time.Minute))
+			rule = evaluateState(rule, false, start.Add(12*time.Minute))
+			Expect(rule.Status.State).To(Equal(v1beta1.StateInactive))
+			Expect(rule.Status.FiredAt).To(BeNil())
+		})
+
+		It("resolves right away without a resolve window", func() {
+			rule := newRule(v1beta1.StateFiring)
+			rule.Spec.KeepFiringFor = nil
+			rule = evaluateState(rule, false, start.Add(2*time.Minute))
+			Expect(rule.Status.State).To(Equal(v1beta1.StateInactive))
+		})
+	})
+
+	Describe("query samples are matched against the condition thresholds", func() {
+		deactivate := resource.MustParse("60")
+		condition := &v1beta1.Condition{
+			Operator:            ">",
+			ActivateThreshold:   resource.MustParse("80"),
+			DeactivateThreshold: &deactivate,
+		}
+
+		newRule := func(state string) v1beta1.PrometheusPatchRule {
+			rule := v1beta1.PrometheusPatchRule{
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Condition: condition.DeepCopy(),
+				},
+			}
+
+			rule.Status.State = state
+			return rule
+		}
+
+		vector := func(values ...float64) model.Vector {
+			var samples model.Vector
+			for _, value := range values {
+				samples = append(samples, &model.Sample{Value: model.SampleValue(value)})
+			}
+
+			return samples
+		}
+
+		It("activates any sample without a condition", func() {
+			rule := newRule(v1beta1.StateInactive)
+			rule.Spec.Condition = nil
+
+			samples, active, err := matchCondition(rule, vector(0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeTrue())
+			Expect(samples).To(HaveLen(1))
+		})
+
+		It("does not activate an inactive rule below the activate threshold", func() {
+			_, active, err := matchCondition(newRule(v1beta1.StateInactive), vector(70))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeFalse())
+		})
+
+		It("keeps a firing rule active above the deactivate threshold", func() {
+			samples, active, err := matchCondition(newRule(v1beta1.StateFiring), vector(70, 50))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeTrue())
+			Expect(samples).To(Equal(vector(70)))
+		})
+
+		It("deactivates a firing rule below the deactivate threshold", func() {
+			_, active, err := matchCondition(newRule(v1beta1.StateFiring), vector(50))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeFalse())
+		})
+
+		It("requires the minimum number of matching samples", func() {
+			rule := newRule(v1beta1.StateInactive)
+			rule.Spec.Condition.MinSamples = 2
+
+			_, active, err := matchCondition(rule, vector(90, 10))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeFalse())
+
+			_, active, err = matchCondition(rule, vector(90, 95))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeTrue())
+		})
+
+		It("handles NaN and infinite values according to the policy", func() {
+			rule := newRule(v1beta1.StateInactive)
+
+			_, active, err := matchCondition(rule, vector(math.NaN(), math.Inf(1)))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeFalse())
+
+			rule.Spec.Condition.NonFinitePolicy = v1beta1.NonFinitePolicyMatch
+			_, active, err = matchCondition(rule, vector(math.NaN()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeTrue())
+
+			rule.Spec.Condition.NonFinitePolicy = v1beta1.NonFinitePolicyInactive
+			_, active, err = matchCondition(rule, vector(90, math.NaN()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeFalse())
+		})
+	})
+
+	Describe("patches of the tier matching the query value are applied", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		one := resource.MustParse("1")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			tierPatch := func(tier string) []v1beta1.MergePatch {
+				return []v1beta1.MergePatch{
+					{
+						Target: v1beta1.Selector{
+							Version:   "v1",
+							Kind:      "ConfigMap",
+							Name:      keyTarget.Name,
+							Namespace: keyTarget.Namespace,
+						},
+						Patch: extv1.JSON{
+							Raw: []byte(fmt.Sprintf(`{"data":{"tier":"%s"}}`, tier)),
+						},
+					},
+				}
+			}
+
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					Tiers: []v1beta1.Tier{
+						{
+							Name:         "low",
+							Max:          &one,
+							MergePatches: tierPatch("low"),
+						},
+						{
+							Name:         "high",
+							Min:          &one,
+							MergePatches: tierPatch("high"),
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("reports the active tier", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return got.Status.ActiveTier == "high"
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("has the patches of the active tier applied", func() {
+			got := &corev1.ConfigMap{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyTarget, got)
+				return got.Data["tier"] == "high"
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Describe("tiers are selected by the sample value", func() {
+		two := resource.MustParse("2")
+		four := resource.MustParse("4")
+
+		rule := v1beta1.PrometheusPatchRule{
+			Spec: v1beta1.PrometheusPatchRuleSpec{
+				MergePatches: []v1beta1.MergePatch{{}},
+				Tiers: []v1beta1.Tier{
+					{Name: "low", Max: &two},
+					{Name: "medium", Min: &two, Max: &four, MergePatches: []v1beta1.MergePatch{{Patch: extv1.JSON{Raw: []byte(`{"data":{"tier":"medium"}}`)}}}},
+					{Name: "high", Min: &four},
+				},
+			},
+		}
+
+		DescribeTable("selects the first tier containing the value",
+			func(value float64, name string) {
+				tier := selectTier(rule, &model.Sample{Value: model.SampleValue(value)})
+				if name == "" {
+					Expect(tier).To(BeNil())
+					return
+				}
+
+				Expect(tier).NotTo(BeNil())
+				Expect(tier.Name).To(Equal(name))
+			},
+			Entry("below the first bound", 1.0, "low"),
+			Entry("inclusive lower bound", 2.0, "medium"),
+			Entry("exclusive upper bound", 4.0, "high"),
+			Entry("NaN", math.NaN(), ""),
+		)
+
+		It("indexes the tier patches within the tier", func() {
+			entries, err := renderTierPatchEntries(&rule.Spec.Tiers[1], newTemplateData(rule, nil))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].index).To(Equal(0))
+			Expect(entries[0].tier).To(Equal("medium"))
+		})
+	})
+
+	Describe("patches are not reverted during the cooldown", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr:   "prometheus_build_info > 0",
+					Revert: true,
+					Cooldown: &metav1.Duration{
+						Duration: time.Hour,
+					},
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					MergePatches: []v1beta1.MergePatch{
+						{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: extv1.JSON{
+								Raw: []byte(`{"metadata":{"annotations":{"foo":"bar"}}}`),
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("records the time the patches have been applied", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return got.Status.LastChangeAt != nil && len(got.Status.Snapshots) == 1
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("keeps the patch while the cooldown is in effect", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Expect(k8sClient.Get(context.Background(), keyRule, got)).Should(Succeed())
+			got.Spec.Expr = "non_existing_metric > 0"
+			Expect(k8sClient.Update(context.Background(), got)).Should(Succeed())
+
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return got.Status.State == v1beta1.StateInactive &&
+					len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[1].Reason == v1beta1.CooldownReason
+			}, timeout, interval).Should(BeTrue())
+
+			target := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(context.Background(), keyTarget, target)).Should(Succeed())
+			Expect(target.Annotations["foo"]).To(Equal("bar"))
+			Expect(got.Status.Snapshots).To(HaveLen(1))
+		})
+	})
+
+	Describe("cooldown", func() {
+		now := time.Now()
+		one := resource.MustParse("1")
+
+		rule := v1beta1.PrometheusPatchRule{
+			Spec: v1beta1.PrometheusPatchRuleSpec{
+				Revert:   true,
+				Cooldown: &metav1.Duration{Duration: 10 * time.Minute},
+				Tiers: []v1beta1.Tier{
+					{Name: "low", Max: &one},
+					{Name: "high", Min: &one},
+				},
+			},
+			Status: v1beta1.PrometheusPatchRuleStatus{
+				ActiveTier:   "low",
+				FiredAt:      &metav1.Time{Time: now.Add(-time.Hour)},
+				LastChangeAt: &metav1.Time{Time: now.Add(-4 * time.Minute)},
+			},
+		}
+
+		It("is in effect until the cooldown elapsed", func() {
+			Expect(cooldownRemaining(rule, now)).To(Equal(6 * time.Minute))
+			Expect(cooldownRemaining(rule, now.Add(time.Hour))).To(BeZero())
+		})
+
+		It("is not in effect without a cooldown", func() {
+			r := *rule.DeepCopy()
+			r.Spec.Cooldown = nil
+			Expect(cooldownRemaining(r, now)).To(BeZero())
+		})
+
+		It("detects a different active tier", func() {
+			Expect(patchSetChanged(rule, model.Vector{{Value: 0}})).To(BeFalse())
+			Expect(patchSetChanged(rule, model.Vector{{Value: 2}})).To(BeTrue())
+		})
+
+		It("detects a tier becoming active after no tier matched", func() {
+			r := *rule.DeepCopy()
+			r.Status.ActiveTier = ""
+			Expect(patchSetChanged(r, model.Vector{{Value: 2}})).To(BeTrue())
+			Expect(patchSetChanged(rule, model.Vector{{Value: model.SampleValue(math.NaN())}})).To(BeTrue())
+		})
+
+		It("detects patches applied again after they have been reverted", func() {
+			r := *rule.DeepCopy()
+			r.Status.FiredAt = &metav1.Time{Time: now}
+			Expect(patchSetChanged(r, model.Vector{{Value: 0}})).To(BeTrue())
+		})
+
+		It("detects the first application", func() {
+			r := *rule.DeepCopy()
+			r.Status.LastChangeAt = nil
+			Expect(patchSetChanged(r, model.Vector{{Value: 0}})).To(BeTrue())
+		})
+	})
+
+	Describe("patches are not applied during a blackout", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr: "prometheus_build_info > 0",
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					Blackouts: []v1beta1.Blackout{
+						{
+							Name:  "freeze",
+							Start: &metav1.Time{Time: time.Now().Add(-time.Hour)},
+							End:   &metav1.Time{Time: time.Now().Add(time.Hour)},
+						},
+					},
+					MergePatches: []v1beta1.MergePatch{
+						{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: extv1.JSON{
+								Raw: []byte(`{"metadata":{"annotations":{"foo":"bar"}}}`),
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("reports that the rule is outside of its schedule", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				for _, condition := range got.Status.Conditions {
+					if condition.Type == v1beta1.PatchAppliedCondition && condition.Reason == v1beta1.OutsideScheduleReason {
+						return true
+					}
+				}
+
+				return false
+			}, timeout, interval).Should(BeTrue())
+
+			Expect(got.Status.LastEvaluation).To(BeNil())
+
+			target := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(context.Background(), keyTarget, target)).Should(Succeed())
+			Expect(target.Annotations).NotTo(HaveKey("foo"))
+		})
+	})
+
+	Describe("schedule", func() {
+		zurich, err := time.LoadLocation("Europe/Zurich")
+		Expect(err).NotTo(HaveOccurred())
+
+		rule := v1beta1.PrometheusPatchRule{
+			Spec: v1beta1.PrometheusPatchRuleSpec{
+				Schedule: &v1beta1.Schedule{
+					TimeZone: "Europe/Zurich",
+					Windows: []v1beta1.Window{
+						{Cron: "0 19 * * *", Duration: metav1.Duration{Duration: 12 * time.Hour}},
+					},
+				},
+				Blackouts: []v1beta1.Blackout{
+					{Name: "release", Cron: "0 9 * * 2", Duration: &metav1.Duration{Duration: 2 * time.Hour}},
+					{Name: "freeze", Start: &metav1.Time{Time: time.Date(2026, 12, 20, 0, 0, 0, 0, time.UTC)}, End: &metav1.Time{Time: time.Date(2027, 1, 5, 0, 0, 0, 0, time.UTC)}},
+				},
+			},
+		}
+
+		DescribeTable("evaluates windows in the time zone of the schedule",
+			func(now time.Time, expected bool) {
+				scheduled, _, err := inSchedule(rule, now)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(scheduled).To(Equal(expected))
+			},
+			Entry("before the window", time.Date(2026, 7, 1, 18, 59, 0, 0, zurich), false),
+			Entry("start of the window", time.Date(2026, 7, 1, 19, 0, 0, 0, zurich), true),
+			Entry("within the window on the next day", time.Date(2026, 7, 2, 6, 59, 0, 0, zurich), true),
+			Entry("end of the window", time.Date(2026, 7, 2, 7, 0, 0, 0, zurich), false),
+			Entry("within the window during winter time", time.Date(2026, 1, 15, 18, 30, 0, 0, time.UTC), true),
+		)
+
+		It("returns the start of the next window", func() {
+			_, next, err := inSchedule(rule, time.Date(2026, 7, 1, 12, 0, 0, 0, zurich))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(next.Equal(time.Date(2026, 7, 1, 19, 0, 0, 0, zurich))).To(BeTrue())
+		})
+
+		DescribeTable("detects active blackouts",
+			func(now time.Time, name string) {
+				blackout, _, err := activeBlackout(rule, now)
+				Expect(err).NotTo(HaveOccurred())
+				if name == "" {
+					Expect(blackout).To(BeNil())
+					return
+				}
+
+				Expect(blackout).NotTo(BeNil())
+				Expect(blackout.Name).To(Equal(name))
+			},
+			Entry("recurring blackout", time.Date(2026, 7, 7, 10, 0, 0, 0, time.UTC), "release"),
+			Entry("after the recurring blackout", time.Date(2026, 7, 7, 11, 0, 0, 0, time.UTC), ""),
+			Entry("fixed blackout", time.Date(2026, 12, 24, 0, 0, 0, 0, time.UTC), "freeze"),
+			Entry("end of the fixed blackout", time.Date(2027, 1, 5, 0, 0, 0, 0, time.UTC), ""),
+		)
+	})
+
+	Describe("patches are not reverted in dry run mode", func() {
+		var (
+			createdRule *v1beta1.PrometheusPatchRule
+			keyRule     types.NamespacedName
+			keyTarget   types.NamespacedName
+		)
+
+		duration, err := time.ParseDuration("5s")
+		Expect(err).NotTo(HaveOccurred(), "failed to parse interval duration")
+
+		It("creates target ConfigMap successfully", func() {
+			keyTarget = types.NamespacedName{
+				Name:      "target-" + randStringRunes(5),
+				Namespace: "default",
+			}
+
+			Expect(k8sClient.Create(context.Background(), &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyTarget.Name,
+					Namespace: keyTarget.Namespace,
+				},
+			})).Should(Succeed())
+		})
+
+		It("creates PrometheusPatchRule successfully", func() {
+			keyRule = types.NamespacedName{
+				Name:      "rule-" + randStringRunes(5),
+				Namespace: "default",
+			}
+			createdRule = &v1beta1.PrometheusPatchRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      keyRule.Name,
+					Namespace: keyRule.Namespace,
+				},
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Expr:   "prometheus_build_info > 0",
+					Revert: true,
+					Interval: metav1.Duration{
+						Duration: duration,
+					},
+					MergePatches: []v1beta1.MergePatch{
+						{
+							Target: v1beta1.Selector{
+								Version:   "v1",
+								Kind:      "ConfigMap",
+								Name:      keyTarget.Name,
+								Namespace: keyTarget.Namespace,
+							},
+							Patch: extv1.JSON{
+								Raw: []byte(`{"metadata":{"annotations":{"foo":"bar"}}}`),
+							},
+						},
+					},
+					Prometheus: v1beta1.PrometheusSpec{
+						Address: container.URI,
+					},
+				},
+			}
+
+			Expect(k8sClient.Create(context.Background(), createdRule)).Should(Succeed())
+		})
+
+		It("patches the target", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return len(got.Status.Snapshots) == 1
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("keeps the patch once the rule is inactive", func() {
+			got := &v1beta1.PrometheusPatchRule{}
+			Expect(k8sClient.Get(context.Background(), keyRule, got)).Should(Succeed())
+			got.Spec.Expr = "non_existing_metric > 0"
+			got.Spec.DryRun = true
+			Expect(k8sClient.Update(context.Background(), got)).Should(Succeed())
+
+			Eventually(func() bool {
+				_ = k8sClient.Get(context.Background(), keyRule, got)
+				return got.Status.State == v1beta1.StateInactive &&
+					len(got.Status.Conditions) == 2 &&
+					got.Status.Conditions[1].Reason == v1beta1.DryRunReason
+			}, timeout, interval).Should(BeTrue())
+
+			target := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(context.Background(), keyTarget, target)).Should(Succeed())
+			Expect(target.Annotations["foo"]).To(Equal("bar"))
+			Expect(got.Status.Snapshots).To(HaveLen(1))
+		})
+	})
+
+	Describe("enforced targets", func() {
+		It("indexes patched targets only", func() {
+			rule := &v1beta1.PrometheusPatchRule{
+				Spec: v1beta1.PrometheusPatchRuleSpec{
+					Enforce: true,
+				},
+				Status: v1beta1.PrometheusPatchRuleStatus{
+					Conditions: []metav1.Condition{
+						{Type: v1beta1.ActiveCondition, Status: metav1.ConditionTrue},
+					},
+					Targets: []v1beta1.TargetStatus{
+						{
+							ResourceReference: v1beta1.ResourceReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "applied"},
+							Result:            v1beta1.TargetResultApplied,
+						},
+						{
+							ResourceReference: v1beta1.ResourceReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "unchanged"},
+							Result:            v1beta1.TargetResultUnchanged,
+						},
+						{
+							ResourceReference: v1beta1.ResourceReference{APIVersion: "apps/", Kind: "deployments", Namespace: "default", Name: "failed"},
+							Result:            v1beta1.TargetResultFailed,
+						},
+					},
+				},
+			}
+
+			Expect(indexTargets(rule)).To(Equal([]string{
+				"apps/v1/Deployment/default/applied",
+				"apps/v1/Deployment/default/unchanged",
+			}))
+		})
+	})
+
+	Describe("target clients", func() {
+		It("are reused as long as the identity does not change", func() {
+			var cache targetClientCache
+			cache.set("default/rule", "serviceaccount/foo", k8sClient)
+
+			kubeClient, ok := cache.get("default/rule", "serviceaccount/foo")
+			Expect(ok).To(BeTrue())
+			Expect(kubeClient).To(BeIdenticalTo(k8sClient))
+
+			_, ok = cache.get("default/rule", "serviceaccount/bar")
+			Expect(ok).To(BeFalse())
+
+			cache.delete("default/rule")
+			_, ok = cache.get("default/rule", "serviceaccount/foo")
+			Expect(ok).To(BeFalse())
+		})
+	})
 })
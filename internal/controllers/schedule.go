@@ -0,0 +1,134 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+// activeBlackout returns the blackout which is in effect at the given time and when it ends.
+// The end is zero for fixed blackouts without an end.
+func activeBlackout(rule v1beta1.PrometheusPatchRule, now time.Time) (*v1beta1.Blackout, time.Time, error) {
+	for i, blackout := range rule.Spec.Blackouts {
+		if blackout.Cron == "" {
+			if blackout.Start == nil && blackout.End == nil {
+				continue
+			}
+
+			if (blackout.Start == nil || !now.Before(blackout.Start.Time)) && (blackout.End == nil || now.Before(blackout.End.Time)) {
+				var end time.Time
+				if blackout.End != nil {
+					end = blackout.End.Time
+				}
+
+				return &rule.Spec.Blackouts[i], end, nil
+			}
+
+			continue
+		}
+
+		if blackout.Duration == nil {
+			return nil, time.Time{}, fmt.Errorf("blackout %s requires a duration", blackout.Name)
+		}
+
+		loc, err := loadLocation(blackout.TimeZone)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		schedule, err := parseCron(blackout.Cron)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		if end, ok := windowEnd(schedule, blackout.Duration.Duration, loc, now); ok {
+			return &rule.Spec.Blackouts[i], end, nil
+		}
+	}
+
+	return nil, time.Time{}, nil
+}
+
+// inSchedule returns whether the given time is within a window of the schedule.
+// Otherwise the start of the next window is returned as well.
+func inSchedule(rule v1beta1.PrometheusPatchRule, now time.Time) (bool, time.Time, error) {
+	if rule.Spec.Schedule == nil {
+		return true, time.Time{}, nil
+	}
+
+	loc, err := loadLocation(rule.Spec.Schedule.TimeZone)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	var next time.Time
+	for _, window := range rule.Spec.Schedule.Windows {
+		schedule, err := parseCron(window.Cron)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+
+		if _, ok := windowEnd(schedule, window.Duration.Duration, loc, now); ok {
+			return true, time.Time{}, nil
+		}
+
+		start := schedule.Next(now.In(loc))
+		if !start.IsZero() && (next.IsZero() || start.Before(next)) {
+			next = start
+		}
+	}
+
+	return false, next, nil
+}
+
+// windowEnd returns whether the given time is within a window starting at the cron schedule and when that window ends
+func windowEnd(schedule cron.Schedule, duration time.Duration, loc *time.Location, now time.Time) (time.Time, bool) {
+	// The latest window which may contain now is the first one starting after now minus its duration
+	start := schedule.Next(now.In(loc).Add(-duration))
+	if start.IsZero() || start.After(now) {
+		return time.Time{}, false
+	}
+
+	return start.Add(duration), true
+}
+
+func parseCron(expr string) (cron.Schedule, error) {
+	schedule, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+
+	return schedule, nil
+}
+
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", name, err)
+	}
+
+	return loc, nil
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+// jsonPatchOperation is a single RFC 6902 operation as sent to the api server
+type jsonPatchOperation struct {
+	OP    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// resourceReference builds a reference to the given object
+func resourceReference(obj *unstructured.Unstructured) v1beta1.ResourceReference {
+	return v1beta1.ResourceReference{
+		APIVersion: obj.GetAPIVersion(),
+		Kind:       obj.GetKind(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+	}
+}
+
+// selectorReference builds a reference from the target selector
+func selectorReference(selector v1beta1.Selector) v1beta1.ResourceReference {
+	kind := selector.Kind
+	if kind == "" {
+		kind = selector.Resource
+	}
+
+	return v1beta1.ResourceReference{
+		APIVersion: schema.GroupVersion{Group: selector.Group, Version: selector.Version}.String(),
+		Kind:       kind,
+		Namespace:  selector.Namespace,
+		Name:       selector.Name,
+	}
+}
+
+// addResourceReference adds the reference if it is not already part of the given references
+func addResourceReference(refs []v1beta1.ResourceReference, ref v1beta1.ResourceReference) []v1beta1.ResourceReference {
+	for _, existing := range refs {
+		if existing == ref {
+			return refs
+		}
+	}
+
+	return append(refs, ref)
+}
+
+// takeSnapshot records the current values of all paths touched by the given patch operations.
+// Paths which have already been recorded are left untouched so the snapshot always reflects
+// the state before the rule patched the object for the first time.
+func takeSnapshot(snapshots []v1beta1.ObjectSnapshot, obj *unstructured.Unstructured, ops []jsonPatchOperation) ([]v1beta1.ObjectSnapshot, error) {
+	ref := resourceReference(obj)
+	index := -1
+	for i, snapshot := range snapshots {
+		if snapshot.ResourceReference == ref {
+			index = i
+			break
+		}
+	}
+
+	if index == -1 {
+		snapshots = append(snapshots, v1beta1.ObjectSnapshot{
+			ResourceReference: ref,
+		})
+		index = len(snapshots) - 1
+	}
+
+	snapshot := &snapshots[index]
+	for _, op := range ops {
+		if op.OP == "test" {
+			continue
+		}
+
+		tokens, err := parsePointer(op.Path)
+		if err != nil {
+			return snapshots, err
+		}
+
+		// Array elements are addressed by their index which shifts on every add or remove operation while
+		// restoring the array as a whole would undo changes made by others while the rule was active.
+		for i := range tokens {
+			ancestor, ok := resolvePointer(obj.Object, tokens[:i])
+			if _, isArray := ancestor.([]interface{}); ok && isArray {
+				return snapshots, fmt.Errorf("reverting array elements is not supported, use an apply patch instead: %s", op.Path)
+			}
+		}
+
+		if len(tokens) == 0 {
+			return snapshots, fmt.Errorf("patching the document root is not supported with revert: %s", op.Path)
+		}
+
+		path := formatPointer(tokens)
+		if isRecorded(snapshot.Paths, path) {
+			continue
+		}
+
+		pathSnapshot := v1beta1.PathSnapshot{
+			Path: path,
+		}
+
+		if value, ok := resolvePointer(obj.Object, tokens); ok {
+			b, err := json.Marshal(value)
+			if err != nil {
+				return snapshots, err
+			}
+
+			pathSnapshot.Value = &extv1.JSON{Raw: b}
+		}
+
+		snapshot.Paths = append(snapshot.Paths, pathSnapshot)
+	}
+
+	return snapshots, nil
+}
+
+// mergePatchOperations converts a (strategic) merge patch document into replace operations
+// for each leaf path so the touched paths can be recorded using takeSnapshot.
+// Arrays and maps containing strategic merge directives are recorded as a whole, the webhook rejects
+// strategic merge patches containing lists if the rule reverts its patches.
+func mergePatchOperations(patch []byte) ([]jsonPatchOperation, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(patch, &doc); err != nil || doc == nil {
+		return nil, errors.New("invalid merge patch, must be an object")
+	}
+
+	var ops []jsonPatchOperation
+	var walk func(node map[string]interface{}, tokens []string)
+	walk = func(node map[string]interface{}, tokens []string) {
+		for key := range node {
+			if strings.HasPrefix(key, "$") && len(tokens) > 0 {
+				ops = append(ops, jsonPatchOperation{OP: "replace", Path: formatPointer(tokens)})
+				return
+			}
+		}
+
+		for key, value := range node {
+			if strings.HasPrefix(key, "$") {
+				continue
+			}
+
+			path := append(append([]string{}, tokens...), key)
+			if child, ok := value.(map[string]interface{}); ok && len(child) > 0 {
+				walk(child, path)
+				continue
+			}
+
+			ops = append(ops, jsonPatchOperation{OP: "replace", Path: formatPointer(path)})
+		}
+	}
+
+	walk(doc, nil)
+
+	// Map iteration is random, keep the recorded paths stable
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Path < ops[j].Path
+	})
+
+	return ops, nil
+}
+
+// revertOperations builds the JSON patch operations required to restore the snapshot on the given object.
+func revertOperations(obj *unstructured.Unstructured, snapshot v1beta1.ObjectSnapshot) ([]jsonPatchOperation, error) {
+	var ops []jsonPatchOperation
+
+	for i := len(snapshot.Paths) - 1; i >= 0; i-- {
+		path := snapshot.Paths[i]
+		tokens, err := parsePointer(path.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if path.Value == nil {
+			if _, ok := resolvePointer(obj.Object, tokens); ok {
+				ops = append(ops, jsonPatchOperation{
+					OP:   "remove",
+					Path: path.Path,
+				})
+			}
+
+			continue
+		}
+
+		ops = append(ops, jsonPatchOperation{
+			OP:    "add",
+			Path:  path.Path,
+			Value: json.RawMessage(path.Value.Raw),
+		})
+	}
+
+	return ops, nil
+}
+
+func isRecorded(paths []v1beta1.PathSnapshot, path string) bool {
+	for _, recorded := range paths {
+		if recorded.Path == path || strings.HasPrefix(path, recorded.Path+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q: must start with /", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+
+	return tokens, nil
+}
+
+// formatPointer builds an RFC 6901 JSON pointer from the given reference tokens
+func formatPointer(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString("/")
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(token))
+	}
+
+	return b.String()
+}
+
+// resolvePointer looks up the value referenced by the given tokens
+func resolvePointer(doc interface{}, tokens []string) (interface{}, bool) {
+	current := doc
+	for _, token := range tokens {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, false
+			}
+
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newDeployment() *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":      "target",
+			"namespace": "default",
+			"annotations": map[string]interface{}{
+				"foo": "bar",
+			},
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name": "app",
+							"env":  []interface{}{},
+						},
+					},
+				},
+			},
+		},
+	}}
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	g := NewWithT(t)
+
+	snapshots, err := takeSnapshot(nil, newDeployment(), []jsonPatchOperation{
+		{OP: "test", Path: "/metadata/name", Value: "target"},
+		{OP: "replace", Path: "/metadata/annotations/foo", Value: "baz"},
+		{OP: "add", Path: "/metadata/labels", Value: map[string]interface{}{"foo": "bar"}},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(snapshots).To(HaveLen(1))
+	g.Expect(snapshots[0].Name).To(Equal("target"))
+	g.Expect(snapshots[0].Paths).To(HaveLen(2))
+	g.Expect(snapshots[0].Paths[0].Path).To(Equal("/metadata/annotations/foo"))
+	g.Expect(snapshots[0].Paths[0].Value.Raw).To(MatchJSON(`"bar"`))
+	g.Expect(snapshots[0].Paths[1].Path).To(Equal("/metadata/labels"))
+	g.Expect(snapshots[0].Paths[1].Value).To(BeNil())
+
+	// The value before the first patch is kept
+	obj := newDeployment()
+	obj.SetAnnotations(map[string]string{"foo": "baz"})
+	snapshots, err = takeSnapshot(snapshots, obj, []jsonPatchOperation{
+		{OP: "replace", Path: "/metadata/annotations", Value: map[string]interface{}{}},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(snapshots).To(HaveLen(1))
+	g.Expect(snapshots[0].Paths).To(HaveLen(3))
+	g.Expect(snapshots[0].Paths[0].Value.Raw).To(MatchJSON(`"bar"`))
+}
+
+func TestTakeSnapshotRejectsArrayElements(t *testing.T) {
+	for _, path := range []string{
+		"/spec/template/spec/containers/0/env/-",
+		"/spec/template/spec/containers/0/name",
+		"/spec/template/spec/containers/-",
+	} {
+		t.Run(path, func(t *testing.T) {
+			g := NewWithT(t)
+
+			_, err := takeSnapshot(nil, newDeployment(), []jsonPatchOperation{
+				{OP: "add", Path: path, Value: "foo"},
+			})
+			g.Expect(err).To(MatchError(ContainSubstring("reverting array elements is not supported")))
+		})
+	}
+}
+
+func TestTakeSnapshotRecordsReplacedArrays(t *testing.T) {
+	g := NewWithT(t)
+
+	snapshots, err := takeSnapshot(nil, newDeployment(), []jsonPatchOperation{
+		{OP: "replace", Path: "/spec/template/spec/containers", Value: []interface{}{}},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(snapshots[0].Paths).To(HaveLen(1))
+	g.Expect(snapshots[0].Paths[0].Path).To(Equal("/spec/template/spec/containers"))
+	g.Expect(snapshots[0].Paths[0].Value.Raw).To(MatchJSON(`[{"name":"app","env":[]}]`))
+}
+
+func TestRevertOperations(t *testing.T) {
+	g := NewWithT(t)
+
+	snapshots, err := takeSnapshot(nil, newDeployment(), []jsonPatchOperation{
+		{OP: "replace", Path: "/metadata/annotations/foo", Value: "baz"},
+		{OP: "add", Path: "/metadata/labels", Value: map[string]interface{}{"foo": "bar"}},
+		{OP: "add", Path: "/spec/replicas", Value: 2},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// spec.replicas has been removed by someone else in the meantime
+	obj := newDeployment()
+	obj.SetAnnotations(map[string]string{"foo": "baz"})
+	obj.SetLabels(map[string]string{"foo": "bar"})
+
+	ops, err := revertOperations(obj, snapshots[0])
+	g.Expect(err).NotTo(HaveOccurred())
+
+	b, err := json.Marshal(ops)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(b).To(MatchJSON(`[
+		{"op":"remove","path":"/metadata/labels"},
+		{"op":"add","path":"/metadata/annotations/foo","value":"bar"}
+	]`))
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/prometheus/common/model"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+// templateData is exposed to patch templates
+type templateData struct {
+	// Value of the query sample
+	Value float64
+
+	// Labels of the query sample
+	Labels map[string]string
+
+	// Rule is the metadata of the PrometheusPatchRule
+	Rule metav1.ObjectMeta
+}
+
+func newTemplateData(rule v1beta1.PrometheusPatchRule, sample *model.Sample) templateData {
+	data := templateData{
+		Labels: make(map[string]string),
+		Rule:   rule.ObjectMeta,
+	}
+
+	if sample == nil {
+		return data
+	}
+
+	data.Value = float64(sample.Value)
+	for name, value := range sample.Metric {
+		data.Labels[string(name)] = string(value)
+	}
+
+	return data
+}
+
+var templateFuncs = template.FuncMap{
+	"int": func(v interface{}) (int64, error) {
+		f, err := toFloat(v)
+		return int64(f), err
+	},
+	"float": toFloat,
+	"quote": func(v interface{}) (string, error) {
+		b, err := json.Marshal(fmt.Sprint(v))
+		return string(b), err
+	},
+	"toJson": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func toFloat(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	default:
+		return 0, fmt.Errorf("can not convert %T to a number", v)
+	}
+}
+
+// render executes the given template text
+func render(text string, data templateData) (string, error) {
+	tmpl, err := template.New("").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// renderPatch builds the JSON patch operations from the given patches.
+// Templated paths get rendered and a value template replaces the static value.
+func renderPatch(patches []v1beta1.JSONPatch, data templateData) ([]jsonPatchOperation, error) {
+	ops := make([]jsonPatchOperation, 0, len(patches))
+
+	for _, patch := range patches {
+		op := jsonPatchOperation{
+			OP:   patch.OP,
+			Path: patch.Path,
+		}
+
+		if strings.Contains(patch.Path, "{{") {
+			path, err := render(patch.Path, data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to render path %q: %w", patch.Path, err)
+			}
+
+			op.Path = path
+		}
+
+		switch {
+		case patch.ValueTemplate != "":
+			value, err := render(patch.ValueTemplate, data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to render value template for path %q: %w", patch.Path, err)
+			}
+
+			b, err := yaml.YAMLToJSON([]byte(value))
+			if err != nil {
+				return nil, fmt.Errorf("rendered value template for path %q is not valid YAML or JSON: %w", patch.Path, err)
+			}
+
+			op.Value = json.RawMessage(b)
+		case len(patch.Value.Raw) > 0:
+			op.Value = json.RawMessage(patch.Value.Raw)
+		}
+
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+// renderSelector renders the templated fields of the target selector
+func renderSelector(selector v1beta1.Selector, data templateData) (v1beta1.Selector, error) {
+	for _, field := range []*string{&selector.Namespace, &selector.Name, &selector.LabelSelector} {
+		if !strings.Contains(*field, "{{") {
+			continue
+		}
+
+		value, err := render(*field, data)
+		if err != nil {
+			return selector, fmt.Errorf("failed to render %q: %w", *field, err)
+		}
+
+		*field = value
+	}
+
+	return selector, nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"math"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+// selectTier returns the first tier whose value range contains the value of the given sample.
+// NaN is not contained in any range.
+func selectTier(rule v1beta1.PrometheusPatchRule, sample *model.Sample) *v1beta1.Tier {
+	if sample == nil || math.IsNaN(float64(sample.Value)) {
+		return nil
+	}
+
+	value := float64(sample.Value)
+	for i, tier := range rule.Spec.Tiers {
+		if tier.Min != nil && value < tier.Min.AsApproximateFloat64() {
+			continue
+		}
+
+		if tier.Max != nil && value >= tier.Max.AsApproximateFloat64() {
+			continue
+		}
+
+		return &rule.Spec.Tiers[i]
+	}
+
+	return nil
+}
+
+// renderTierPatchEntries renders the patches of the given tier.
+// The entries are indexed within the patches of the tier and reference the tier by its name.
+func renderTierPatchEntries(tier *v1beta1.Tier, data templateData) ([]patchEntry, error) {
+	if tier == nil {
+		return nil, nil
+	}
+
+	entries, err := renderPatchEntries(v1beta1.PrometheusPatchRule{
+		Spec: v1beta1.PrometheusPatchRuleSpec{
+			JSON6902Patches:       tier.JSON6902Patches,
+			ApplyPatches:          tier.ApplyPatches,
+			StrategicMergePatches: tier.StrategicMergePatches,
+			MergePatches:          tier.MergePatches,
+		},
+	}, data)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		entries[i].tier = tier.Name
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+const (
+	targetIndex = ".status.targets"
+)
+
+// targetWatcher registers watches for the kinds of patched targets at runtime
+type targetWatcher struct {
+	mu         sync.Mutex
+	controller controller.Controller
+	cache      cache.Cache
+	handler    handler.EventHandler
+	watched    map[schema.GroupVersionKind]struct{}
+}
+
+// watch starts watching the given kind unless it is already watched
+func (w *targetWatcher) watch(gvk schema.GroupVersionKind) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.watched[gvk]; ok {
+		return nil
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+
+	if err := w.controller.Watch(source.Kind(w.cache, obj), w.handler, predicate.Funcs{UpdateFunc: targetChanged}); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", gvk.String(), err)
+	}
+
+	if w.watched == nil {
+		w.watched = make(map[schema.GroupVersionKind]struct{})
+	}
+
+	w.watched[gvk] = struct{}{}
+	return nil
+}
+
+// targetChanged filters updates which only change the status of a target.
+// Not all kinds track changes in metadata.generation, therefore the objects are compared without their status.
+func targetChanged(e event.UpdateEvent) bool {
+	if e.ObjectOld == nil || e.ObjectNew == nil {
+		return true
+	}
+
+	if e.ObjectOld.GetGeneration() != e.ObjectNew.GetGeneration() {
+		return true
+	}
+
+	oldObj, okOld := e.ObjectOld.(*unstructured.Unstructured)
+	newObj, okNew := e.ObjectNew.(*unstructured.Unstructured)
+	if !okOld || !okNew {
+		return true
+	}
+
+	return !equality.Semantic.DeepEqual(withoutStatus(oldObj), withoutStatus(newObj))
+}
+
+// withoutStatus returns a copy of the object without its status and the metadata updated with each write
+func withoutStatus(obj *unstructured.Unstructured) map[string]interface{} {
+	obj = obj.DeepCopy()
+	unstructured.RemoveNestedField(obj.Object, "status")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "resourceVersion")
+	unstructured.RemoveNestedField(obj.Object, "metadata", "managedFields")
+	return obj.Object
+}
+
+// targetIndexKey builds the index key of a target
+func targetIndexKey(ref v1beta1.ResourceReference) string {
+	return fmt.Sprintf("%s/%s/%s/%s", ref.APIVersion, ref.Kind, ref.Namespace, ref.Name)
+}
+
+// indexTargets indexes the targets of rules which enforce their patches.
+// Targets in remote clusters are not watched and therefore not indexed.
+// Only targets recorded in the status are indexed, see --max-status-targets.
+func indexTargets(o client.Object) []string {
+	rule := o.(*v1beta1.PrometheusPatchRule)
+	if !rule.Spec.Enforce || rule.Spec.DryRun || rule.Spec.KubeConfig != nil || !apimeta.IsStatusConditionTrue(rule.Status.Conditions, v1beta1.ActiveCondition) {
+		return nil
+	}
+
+	var keys []string
+	for _, target := range rule.Status.Targets {
+		if !isPatched(target) {
+			continue
+		}
+
+		keys = append(keys, targetIndexKey(target.ResourceReference))
+	}
+
+	return keys
+}
+
+func (r *PrometheusPatchRuleReconciler) requestsForTarget(ctx context.Context, obj client.Object) []reconcile.Request {
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	key := targetIndexKey(v1beta1.ResourceReference{
+		APIVersion: gvk.GroupVersion().String(),
+		Kind:       gvk.Kind,
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+	})
+
+	var list v1beta1.PrometheusPatchRuleList
+	if err := r.List(ctx, &list, client.MatchingFields{
+		targetIndex: key,
+	}); err != nil {
+		return nil
+	}
+
+	var reqs []reconcile.Request
+	for _, rule := range list.Items {
+		r.Log.V(1).Info("patched target changed, requeuing rule", "namespace", rule.GetNamespace(), "name", rule.GetName(), "target", key)
+		reqs = append(reqs, reconcile.Request{NamespacedName: objectKey(&rule)})
+	}
+
+	return reqs
+}
+
+// watchTargets makes sure all kinds of the targets of the rule are watched
+func (r *PrometheusPatchRuleReconciler) watchTargets(rule v1beta1.PrometheusPatchRule) error {
+	if r.watcher == nil || rule.Spec.KubeConfig != nil {
+		return nil
+	}
+
+	var errs []error
+	for _, target := range rule.Status.Targets {
+		if !isPatched(target) {
+			continue
+		}
+
+		gv, err := schema.ParseGroupVersion(target.APIVersion)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := r.watcher.watch(gv.WithKind(target.Kind)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// isPatched returns whether the target has been found and patched. Only those targets reference
+// the kind of the object as resolved by the api server, failed targets reference the selector.
+func isPatched(target v1beta1.TargetStatus) bool {
+	return target.Result == v1beta1.TargetResultApplied || target.Result == v1beta1.TargetResultUnchanged
+}
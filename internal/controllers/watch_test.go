@@ -0,0 +1,107 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+func TestIndexTargetsOfAppliedPatches(t *testing.T) {
+	g := NewWithT(t)
+	r := newFakeReconciler(g, interceptor.Funcs{}, newConfigMap("target", nil))
+
+	rule := newAnnotationPatchRule("target")
+	rule.Spec.Enforce = true
+	apimeta.SetStatusCondition(&rule.Status.Conditions, metav1.Condition{
+		Type:   v1beta1.ActiveCondition,
+		Status: metav1.ConditionTrue,
+		Reason: v1beta1.ActiveReason,
+	})
+
+	rule, _, err := r.applyPatches(context.Background(), rule, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(indexTargets(&rule)).To(Equal([]string{"v1/ConfigMap/default/target"}))
+}
+
+func TestTargetChanged(t *testing.T) {
+	g := NewWithT(t)
+
+	deployment := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":            "target",
+			"namespace":       "default",
+			"generation":      int64(1),
+			"resourceVersion": "1",
+		},
+		"spec": map[string]interface{}{
+			"replicas": int64(1),
+		},
+	}}
+
+	update := func(old *unstructured.Unstructured, mutate func(obj *unstructured.Unstructured)) bool {
+		obj := old.DeepCopy()
+		obj.SetResourceVersion("2")
+		mutate(obj)
+		return targetChanged(event.UpdateEvent{ObjectOld: old, ObjectNew: obj})
+	}
+
+	g.Expect(update(deployment, func(obj *unstructured.Unstructured) {
+		_ = unstructured.SetNestedField(obj.Object, int64(1), "status", "readyReplicas")
+	})).To(BeFalse())
+
+	g.Expect(update(deployment, func(obj *unstructured.Unstructured) {
+		_ = unstructured.SetNestedField(obj.Object, int64(2), "spec", "replicas")
+		obj.SetGeneration(2)
+	})).To(BeTrue())
+
+	g.Expect(update(deployment, func(obj *unstructured.Unstructured) {
+		obj.SetLabels(map[string]string{"foo": "bar"})
+	})).To(BeTrue())
+
+	g.Expect(update(deployment, func(obj *unstructured.Unstructured) {
+		obj.SetAnnotations(map[string]string{"foo": "bar"})
+	})).To(BeTrue())
+
+	// ConfigMaps do not track their generation
+	configMap := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":            "target",
+			"namespace":       "default",
+			"resourceVersion": "1",
+		},
+	}}
+
+	g.Expect(update(configMap, func(obj *unstructured.Unstructured) {
+		_ = unstructured.SetNestedField(obj.Object, "bar", "data", "foo")
+	})).To(BeTrue())
+
+	g.Expect(update(configMap, func(obj *unstructured.Unstructured) {})).To(BeFalse())
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/robfig/cron/v3"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+//+kubebuilder:webhook:path=/validate-metrics-infra-doodle-com-v1beta1-prometheuspatchrule,mutating=false,failurePolicy=fail,sideEffects=None,groups=metrics.infra.doodle.com,resources=prometheuspatchrules,verbs=create;update,versions=v1beta1,name=vprometheuspatchrule.metrics.infra.doodle.com,admissionReviewVersions=v1
+
+// jsonPatchOperations are the supported operations defined by RFC 6902.
+// move and copy require a from pointer which is not part of the api.
+var jsonPatchOperations = []string{"add", "remove", "replace", "test"}
+
+// PrometheusPatchRuleValidator validates PrometheusPatchRules before they get persisted
+type PrometheusPatchRuleValidator struct {
+	// Mapper is used to verify that the kinds of the targets exist.
+	// If not set the RESTMapper of the manager is used.
+	Mapper meta.RESTMapper
+}
+
+var _ admission.CustomValidator = &PrometheusPatchRuleValidator{}
+
+// SetupWebhookWithManager registers the validating webhook with the manager
+func (v *PrometheusPatchRuleValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	if v.Mapper == nil {
+		v.Mapper = mgr.GetRESTMapper()
+	}
+
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&v1beta1.PrometheusPatchRule{}).
+		WithValidator(v).
+		Complete()
+}
+
+// ValidateCreate validates a new PrometheusPatchRule
+func (v *PrometheusPatchRuleValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, v.validate(obj)
+}
+
+// ValidateUpdate validates an updated PrometheusPatchRule
+func (v *PrometheusPatchRuleValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	return nil, v.validate(newObj)
+}
+
+// ValidateDelete does nothing, a PrometheusPatchRule may always be deleted
+func (v *PrometheusPatchRuleValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *PrometheusPatchRuleValidator) validate(obj runtime.Object) error {
+	rule, ok := obj.(*v1beta1.PrometheusPatchRule)
+	if !ok {
+		return fmt.Errorf("expected a PrometheusPatchRule but got %T", obj)
+	}
+
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+
+	if rule.Spec.Expr == "" {
+		errs = append(errs, field.Required(spec.Child("expr"), "expression is required"))
+	} else if _, err := parser.ParseExpr(rule.Spec.Expr); err != nil {
+		errs = append(errs, field.Invalid(spec.Child("expr"), rule.Spec.Expr, err.Error()))
+	}
+
+	if rule.Spec.Interval.Duration <= 0 {
+		errs = append(errs, field.Invalid(spec.Child("interval"), rule.Spec.Interval.Duration.String(), "must be greater than 0"))
+	}
+
+	errs = append(errs, v.validatePatches(rule, spec, rule.Spec.JSON6902Patches, rule.Spec.ApplyPatches, rule.Spec.StrategicMergePatches, rule.Spec.MergePatches)...)
+
+	names := make(map[string]struct{})
+	for i, tier := range rule.Spec.Tiers {
+		path := spec.Child("tiers").Index(i)
+		if _, ok := names[tier.Name]; ok {
+			errs = append(errs, field.Duplicate(path.Child("name"), tier.Name))
+		}
+
+		names[tier.Name] = struct{}{}
+
+		if tier.Min != nil && tier.Max != nil && tier.Min.Cmp(*tier.Max) >= 0 {
+			errs = append(errs, field.Invalid(path.Child("max"), tier.Max.String(), "must be greater than min"))
+		}
+
+		errs = append(errs, v.validatePatches(rule, path, tier.JSON6902Patches, tier.ApplyPatches, tier.StrategicMergePatches, tier.MergePatches)...)
+	}
+
+	if schedule := rule.Spec.Schedule; schedule != nil {
+		path := spec.Child("schedule")
+		errs = append(errs, validateTimeZone(path.Child("timeZone"), schedule.TimeZone)...)
+
+		for i, window := range schedule.Windows {
+			errs = append(errs, validateWindow(path.Child("windows").Index(i), window.Cron, window.Duration.Duration)...)
+		}
+	}
+
+	names = make(map[string]struct{})
+	for i, blackout := range rule.Spec.Blackouts {
+		path := spec.Child("blackouts").Index(i)
+		if _, ok := names[blackout.Name]; ok {
+			errs = append(errs, field.Duplicate(path.Child("name"), blackout.Name))
+		}
+
+		names[blackout.Name] = struct{}{}
+		errs = append(errs, validateTimeZone(path.Child("timeZone"), blackout.TimeZone)...)
+
+		switch {
+		case blackout.Cron != "" && (blackout.Start != nil || blackout.End != nil):
+			errs = append(errs, field.Forbidden(path.Child("cron"), "either cron or start and end may be set"))
+		case blackout.Cron != "" && blackout.Duration == nil:
+			errs = append(errs, field.Required(path.Child("duration"), "a recurring blackout requires a duration"))
+		case blackout.Cron != "":
+			errs = append(errs, validateWindow(path, blackout.Cron, blackout.Duration.Duration)...)
+		case blackout.Start == nil && blackout.End == nil:
+			errs = append(errs, field.Required(path.Child("start"), "blackout requires either cron or start and end"))
+		case blackout.Start != nil && blackout.End != nil && !blackout.Start.Before(blackout.End):
+			errs = append(errs, field.Invalid(path.Child("end"), blackout.End.String(), "must be after start"))
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return kerrors.NewInvalid(v1beta1.GroupVersion.WithKind(v1beta1.PrometheusPatchRuleKind).GroupKind(), rule.Name, errs)
+}
+
+// validatePatches validates the targets and JSON patches of a patch set
+func (v *PrometheusPatchRuleValidator) validatePatches(rule *v1beta1.PrometheusPatchRule, path *field.Path, json6902Patches []v1beta1.JSON6902Patch, applyPatches []v1beta1.ApplyPatch, strategicMergePatches, mergePatches []v1beta1.MergePatch) field.ErrorList {
+	var errs field.ErrorList
+
+	for i, patch := range json6902Patches {
+		patchPath := path.Child("json6902Patches").Index(i)
+		errs = append(errs, v.validateTarget(rule, patchPath.Child("target"), patch.Target)...)
+
+		for j, op := range patch.Patch {
+			errs = append(errs, validateJSONPatch(patchPath.Child("patch").Index(j), op)...)
+
+			if rule.Spec.Revert && op.OP != "test" && addressesArrayElement(op.Path) {
+				errs = append(errs, field.Forbidden(patchPath.Child("patch").Index(j).Child("path"), "reverting array elements is not supported, use an apply patch instead"))
+			}
+		}
+	}
+
+	for i, patch := range applyPatches {
+		errs = append(errs, v.validateTarget(rule, path.Child("applyPatches").Index(i).Child("target"), patch.Target)...)
+	}
+
+	for i, patch := range strategicMergePatches {
+		patchPath := path.Child("strategicMergePatches").Index(i)
+		errs = append(errs, v.validateTarget(rule, patchPath.Child("target"), patch.Target)...)
+
+		if rule.Spec.Revert && containsList(patch.Patch.Raw) {
+			errs = append(errs, field.Forbidden(patchPath.Child("patch"), "reverting merged list items is not supported, use an apply patch instead"))
+		}
+	}
+
+	for i, patch := range mergePatches {
+		errs = append(errs, v.validateTarget(rule, path.Child("mergePatches").Index(i).Child("target"), patch.Target)...)
+	}
+
+	return errs
+}
+
+// validateWindow validates the cron expression and the duration of a recurring time window
+func validateWindow(path *field.Path, expr string, duration time.Duration) field.ErrorList {
+	var errs field.ErrorList
+
+	if _, err := cron.ParseStandard(expr); err != nil {
+		errs = append(errs, field.Invalid(path.Child("cron"), expr, err.Error()))
+	}
+
+	if duration <= 0 {
+		errs = append(errs, field.Invalid(path.Child("duration"), duration.String(), "must be greater than 0"))
+	}
+
+	return errs
+}
+
+func validateTimeZone(path *field.Path, name string) field.ErrorList {
+	if _, err := time.LoadLocation(name); err != nil {
+		return field.ErrorList{field.Invalid(path, name, "unknown time zone")}
+	}
+
+	return nil
+}
+
+// validateJSONPatch validates the operation and the JSON pointer of a patch.
+// Templated paths are only known after rendering and are not validated.
+func validateJSONPatch(path *field.Path, patch v1beta1.JSONPatch) field.ErrorList {
+	var errs field.ErrorList
+
+	if !contains(jsonPatchOperations, patch.OP) {
+		errs = append(errs, field.NotSupported(path.Child("op"), patch.OP, jsonPatchOperations))
+	}
+
+	if !strings.Contains(patch.Path, "{{") {
+		if err := validatePointer(patch.Path); err != nil {
+			errs = append(errs, field.Invalid(path.Child("path"), patch.Path, err.Error()))
+		}
+	}
+
+	return errs
+}
+
+// validatePointer validates the syntax of an RFC 6901 JSON pointer
+func validatePointer(pointer string) error {
+	if pointer == "" {
+		return nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return fmt.Errorf("must start with /")
+	}
+
+	for i := 0; i < len(pointer); i++ {
+		if pointer[i] != '~' {
+			continue
+		}
+
+		if i+1 == len(pointer) || (pointer[i+1] != '0' && pointer[i+1] != '1') {
+			return fmt.Errorf("~ must be escaped as ~0")
+		}
+	}
+
+	return nil
+}
+
+// addressesArrayElement returns whether the pointer references an array element by its index or the end of an array.
+// Numeric object keys can not be told apart from array indices without the target and are treated as indices.
+// Templated tokens are only known after rendering and are verified by the controller.
+func addressesArrayElement(pointer string) bool {
+	if pointer == "" || strings.Contains(pointer, "{{") {
+		return false
+	}
+
+	for _, token := range strings.Split(pointer[1:], "/") {
+		if token == "-" {
+			return true
+		}
+
+		if _, err := strconv.ParseUint(token, 10, 64); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsList returns whether the merge patch document contains a list.
+// Strategic merge patches merge list items into the lists of the target.
+func containsList(raw []byte) bool {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return false
+	}
+
+	var walk func(node interface{}) bool
+	walk = func(node interface{}) bool {
+		switch node := node.(type) {
+		case []interface{}:
+			return true
+		case map[string]interface{}:
+			for _, value := range node {
+				if walk(value) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	return walk(doc)
+}
+
+// validateTarget validates that the kind of the target exists.
+// Targets in remote clusters can not be verified and are skipped.
+func (v *PrometheusPatchRuleValidator) validateTarget(rule *v1beta1.PrometheusPatchRule, path *field.Path, target v1beta1.Selector) field.ErrorList {
+	if target.Kind == "" && target.Resource == "" {
+		return field.ErrorList{field.Required(path.Child("kind"), "target requires either kind or resource")}
+	}
+
+	if rule.Spec.KubeConfig != nil || v.Mapper == nil {
+		return nil
+	}
+
+	var err error
+	if target.Kind != "" {
+		var versions []string
+		if target.Version != "" {
+			versions = append(versions, target.Version)
+		}
+
+		_, err = v.Mapper.RESTMapping(schema.GroupKind{Group: target.Group, Kind: target.Kind}, versions...)
+		path = path.Child("kind")
+	} else {
+		_, err = v.Mapper.KindFor(schema.GroupVersionResource{Group: target.Group, Version: target.Version, Resource: target.Resource})
+		path = path.Child("resource")
+	}
+
+	switch {
+	case meta.IsNoMatchError(err):
+		return field.ErrorList{field.Invalid(path, selectorString(target), "target kind does not exist")}
+	case err != nil:
+		return field.ErrorList{field.InternalError(path, err)}
+	}
+
+	return nil
+}
+
+func selectorString(target v1beta1.Selector) string {
+	kind := target.Kind
+	if kind == "" {
+		kind = target.Resource
+	}
+
+	return schema.GroupVersion{Group: target.Group, Version: target.Version}.WithKind(kind).String()
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
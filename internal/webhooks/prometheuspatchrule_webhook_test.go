@@ -0,0 +1,198 @@
+/*
+Copyright 2022 Doodle.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	extv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
+)
+
+var _ = Describe("PrometheusPatchRuleValidator", func() {
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, apimeta.RESTScopeNamespace)
+
+	validator := &PrometheusPatchRuleValidator{Mapper: mapper}
+
+	newRule := func(mutate func(rule *v1beta1.PrometheusPatchRule)) *v1beta1.PrometheusPatchRule {
+		rule := &v1beta1.PrometheusPatchRule{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "rule",
+				Namespace: "default",
+			},
+			Spec: v1beta1.PrometheusPatchRuleSpec{
+				Expr: "sum(rate(http_requests_total[5m])) > 0",
+				Interval: metav1.Duration{
+					Duration: time.Minute,
+				},
+				JSON6902Patches: []v1beta1.JSON6902Patch{
+					{
+						Target: v1beta1.Selector{
+							Version: "v1",
+							Kind:    "ConfigMap",
+							Name:    "foo",
+						},
+						Patch: []v1beta1.JSONPatch{
+							{
+								OP:   "add",
+								Path: "/metadata/annotations/foo~1bar",
+							},
+						},
+					},
+				},
+			},
+		}
+
+		mutate(rule)
+		return rule
+	}
+
+	DescribeTable("validates rules",
+		func(mutate func(rule *v1beta1.PrometheusPatchRule), field string) {
+			_, err := validator.ValidateCreate(context.Background(), newRule(mutate))
+			if field == "" {
+				Expect(err).NotTo(HaveOccurred())
+				return
+			}
+
+			Expect(kerrors.IsInvalid(err)).To(BeTrue(), "expected an invalid error but got %v", err)
+			Expect(err.Error()).To(ContainSubstring(field))
+		},
+		Entry("valid rule", func(rule *v1beta1.PrometheusPatchRule) {}, ""),
+		Entry("templated path", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.JSON6902Patches[0].Patch[0].Path = "/data/{{ .Labels.key }}"
+		}, ""),
+		Entry("invalid expression", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Expr = "invalid)"
+		}, "spec.expr"),
+		Entry("missing expression", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Expr = ""
+		}, "spec.expr"),
+		Entry("zero interval", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Interval.Duration = 0
+		}, "spec.interval"),
+		Entry("unsupported operation", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.JSON6902Patches[0].Patch[0].OP = "set"
+		}, "spec.json6902Patches[0].patch[0].op"),
+		Entry("move operation without from pointer", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.JSON6902Patches[0].Patch[0].OP = "move"
+		}, "spec.json6902Patches[0].patch[0].op"),
+		Entry("pointer without leading slash", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.JSON6902Patches[0].Patch[0].Path = "metadata/annotations"
+		}, "spec.json6902Patches[0].patch[0].path"),
+		Entry("pointer with invalid escape", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.JSON6902Patches[0].Patch[0].Path = "/metadata/annotations/foo~bar"
+		}, "spec.json6902Patches[0].patch[0].path"),
+		Entry("unknown target kind", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.JSON6902Patches[0].Target.Kind = "DoesNotExist"
+		}, "spec.json6902Patches[0].target.kind"),
+		Entry("array element without revert", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.JSON6902Patches[0].Patch[0].Path = "/spec/template/spec/containers/0/env/-"
+		}, ""),
+		Entry("array element with revert", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Revert = true
+			rule.Spec.JSON6902Patches[0].Patch[0].Path = "/spec/template/spec/containers/0/env/-"
+		}, "spec.json6902Patches[0].patch[0].path"),
+		Entry("appended array element with revert", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Revert = true
+			rule.Spec.JSON6902Patches[0].Patch[0].Path = "/spec/template/spec/containers/-"
+		}, "spec.json6902Patches[0].patch[0].path"),
+		Entry("strategic merge patch with a list and revert", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Revert = true
+			rule.Spec.StrategicMergePatches = []v1beta1.MergePatch{{
+				Target: v1beta1.Selector{Version: "v1", Kind: "ConfigMap", Name: "foo"},
+				Patch:  extv1.JSON{Raw: []byte(`{"spec":{"containers":[{"name":"app","image":"app:v2"}]}}`)},
+			}}
+		}, "spec.strategicMergePatches[0].patch"),
+		Entry("merge patch with a list and revert", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Revert = true
+			rule.Spec.MergePatches = []v1beta1.MergePatch{{
+				Target: v1beta1.Selector{Version: "v1", Kind: "ConfigMap", Name: "foo"},
+				Patch:  extv1.JSON{Raw: []byte(`{"spec":{"containers":[{"name":"app","image":"app:v2"}]}}`)},
+			}}
+		}, ""),
+		Entry("target without kind", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.JSON6902Patches[0].Target.Kind = ""
+		}, "spec.json6902Patches[0].target.kind"),
+		Entry("valid schedule and blackouts", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Schedule = &v1beta1.Schedule{
+				TimeZone: "Europe/Zurich",
+				Windows:  []v1beta1.Window{{Cron: "0 19 * * *", Duration: metav1.Duration{Duration: 12 * time.Hour}}},
+			}
+			rule.Spec.Blackouts = []v1beta1.Blackout{
+				{Name: "release", Cron: "0 9 * * 2", Duration: &metav1.Duration{Duration: time.Hour}},
+				{Name: "freeze", Start: &metav1.Time{Time: time.Now()}, End: &metav1.Time{Time: time.Now().Add(time.Hour)}},
+			}
+		}, ""),
+		Entry("invalid schedule time zone", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Schedule = &v1beta1.Schedule{
+				TimeZone: "Europe/Atlantis",
+				Windows:  []v1beta1.Window{{Cron: "0 19 * * *", Duration: metav1.Duration{Duration: time.Hour}}},
+			}
+		}, "spec.schedule.timeZone"),
+		Entry("invalid schedule cron expression", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Schedule = &v1beta1.Schedule{
+				Windows: []v1beta1.Window{{Cron: "every night", Duration: metav1.Duration{Duration: time.Hour}}},
+			}
+		}, "spec.schedule.windows[0].cron"),
+		Entry("schedule window without duration", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Schedule = &v1beta1.Schedule{
+				Windows: []v1beta1.Window{{Cron: "0 19 * * *"}},
+			}
+		}, "spec.schedule.windows[0].duration"),
+		Entry("recurring blackout without duration", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Blackouts = []v1beta1.Blackout{{Name: "release", Cron: "0 9 * * 2"}}
+		}, "spec.blackouts[0].duration"),
+		Entry("blackout without time range", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Blackouts = []v1beta1.Blackout{{Name: "freeze"}}
+		}, "spec.blackouts[0].start"),
+		Entry("blackout ending before start", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Blackouts = []v1beta1.Blackout{
+				{Name: "freeze", Start: &metav1.Time{Time: time.Now()}, End: &metav1.Time{Time: time.Now().Add(-time.Hour)}},
+			}
+		}, "spec.blackouts[0].end"),
+		Entry("duplicate tier names", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Tiers = []v1beta1.Tier{{Name: "low"}, {Name: "low"}}
+		}, "spec.tiers[1].name"),
+		Entry("tier with an empty range", func(rule *v1beta1.PrometheusPatchRule) {
+			min, max := resource.MustParse("4"), resource.MustParse("2")
+			rule.Spec.Tiers = []v1beta1.Tier{{Name: "low", Min: &min, Max: &max}}
+		}, "spec.tiers[0].max"),
+		Entry("unknown target kind of a tier", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.Tiers = []v1beta1.Tier{{Name: "low", JSON6902Patches: []v1beta1.JSON6902Patch{
+				{Target: v1beta1.Selector{Kind: "DoesNotExist"}},
+			}}}
+		}, "spec.tiers[0].json6902Patches[0].target.kind"),
+		Entry("unknown target kind in a remote cluster", func(rule *v1beta1.PrometheusPatchRule) {
+			rule.Spec.JSON6902Patches[0].Target.Kind = "DoesNotExist"
+			rule.Spec.KubeConfig = &meta.KubeConfigReference{
+				SecretRef: meta.SecretKeyReference{Name: "kubeconfig"},
+			}
+		}, ""),
+	)
+})
@@ -23,6 +23,7 @@ import (
 
 	infrav1beta1 "github.com/doodlescheduling/prometheus-patch-controller/api/v1beta1"
 	"github.com/doodlescheduling/prometheus-patch-controller/internal/controllers"
+	"github.com/doodlescheduling/prometheus-patch-controller/internal/webhooks"
 	"github.com/fluxcd/pkg/runtime/client"
 	helper "github.com/fluxcd/pkg/runtime/controller"
 	"github.com/fluxcd/pkg/runtime/leaderelection"
@@ -63,6 +64,10 @@ var (
 	rateLimiterOptions      helper.RateLimiterOptions
 	watchOptions            helper.WatchOptions
 	fieldManager            = "prometheus-patch-controller"
+	dryRun                  bool
+	maxStatusTargets        int
+	defaultServiceAccount   string
+	enableWebhook           bool
 )
 
 func main() {
@@ -75,6 +80,14 @@ func main() {
 		"The number of concurrent Pod reconciles.")
 	flag.DurationVar(&gracefulShutdownTimeout, "graceful-shutdown-timeout", 600*time.Second,
 		"The duration given to the reconciler to finish before forcibly stopping.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Send all patches as dry run requests. Nothing gets persisted, the resulting diffs are recorded in the status of each rule.")
+	flag.IntVar(&maxStatusTargets, "max-status-targets", 100,
+		"The maximum number of targets recorded in the status of a rule. Set to 0 for no limit.")
+	flag.StringVar(&defaultServiceAccount, "default-service-account", "",
+		"The service account impersonated to patch the targets of rules which do not specify spec.serviceAccountName.")
+	flag.BoolVar(&enableWebhook, "enable-webhook", false,
+		"Serve the validating admission webhook for PrometheusPatchRules on port 9443.")
 
 	clientOptions.BindFlags(flag.CommandLine)
 	logOptions.BindFlags(flag.CommandLine)
@@ -114,6 +127,12 @@ func main() {
 		GracefulShutdownTimeout:       &gracefulShutdownTimeout,
 		Port:                          9443,
 		LeaderElectionID:              leaderElectionId,
+		Client: ctrlclient.Options{
+			Cache: &ctrlclient.CacheOptions{
+				// Secrets and ConfigMaps are read on demand instead of caching all of them
+				DisableFor: []ctrlclient.Object{&corev1.Secret{}, &corev1.ConfigMap{}},
+			},
+		},
 		Cache: ctrlcache.Options{
 			ByObject: map[ctrlclient.Object]ctrlcache.ByObject{
 				&infrav1beta1.PrometheusPatchRule{}: {Label: watchSelector},
@@ -143,16 +162,28 @@ func main() {
 	}
 
 	if err = (&controllers.PrometheusPatchRuleReconciler{
-		Client:       mgr.GetClient(),
-		FieldManager: fieldManager,
-		Log:          ctrl.Log.WithName("controllers").WithName("PrometheusPatchRule"),
-		Scheme:       mgr.GetScheme(),
-		Recorder:     mgr.GetEventRecorderFor("PrometheusPatchRule"),
+		Client:                mgr.GetClient(),
+		FieldManager:          fieldManager,
+		Log:                   ctrl.Log.WithName("controllers").WithName("PrometheusPatchRule"),
+		Scheme:                mgr.GetScheme(),
+		Recorder:              mgr.GetEventRecorderFor("PrometheusPatchRule"),
+		RuntimeNamespace:      os.Getenv("RUNTIME_NAMESPACE"),
+		DryRun:                dryRun,
+		MaxStatusTargets:      maxStatusTargets,
+		KubeConfigOpts:        kubeConfigOpts,
+		DefaultServiceAccount: defaultServiceAccount,
 	}).SetupWithManager(mgr, controllers.PrometheusPatchRuleReconcilerOptions{MaxConcurrentReconciles: concurrent}); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "PrometheusPatchRule")
 		os.Exit(1)
 	}
 
+	if enableWebhook {
+		if err = (&webhooks.PrometheusPatchRuleValidator{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "PrometheusPatchRule")
+			os.Exit(1)
+		}
+	}
+
 	// +kubebuilder:scaffold:builder
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {